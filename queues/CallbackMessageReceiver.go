@@ -5,6 +5,9 @@ type CallbackMessageReceiver struct {
 	Callback func(message *MessageEnvelope, queue IMessageQueue) error
 }
 
+// NewCallbackMessageReceiver method are creates a new receiver that wraps the given callback.
+//   - callback  a function to be called for each incoming message.
+// Returns: *CallbackMessageReceiver
 func NewCallbackMessageReceiver(callback func(message *MessageEnvelope, queue IMessageQueue) error) *CallbackMessageReceiver {
 	c := CallbackMessageReceiver{
 		Callback: callback,
@@ -12,6 +15,10 @@ func NewCallbackMessageReceiver(callback func(message *MessageEnvelope, queue IM
 	return &c
 }
 
+// ReceiveMessage method are receives incoming message from the queue and passes it to the callback.
+//   - message   an incoming message
+//   - queue     a queue where the message comes from
+// Returns: error returned by the callback.
 func (c *CallbackMessageReceiver) ReceiveMessage(message *MessageEnvelope, queue IMessageQueue) (err error) {
 	return c.Callback(message, queue)
 }
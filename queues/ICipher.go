@@ -0,0 +1,31 @@
+package queues
+
+/*
+ICipher interface for components that encrypt and decrypt message payloads.
+When a cipher is referenced by a message queue, messages are stored encrypted inside the queue
+and decrypted transparently when they are received or peeked.
+
+Example:
+
+    type MyCipher struct {}
+
+    func (c *MyCipher) Encrypt(data []byte) ([]byte, error) { ... }
+    func (c *MyCipher) Decrypt(data []byte) ([]byte, error) { ... }
+
+    references := cref.NewReferencesFromTuples(
+        cref.NewDescriptor("mygroup", "cipher", "default", "default", "1.0"), &MyCipher{},
+    )
+    queue.SetReferences(references)
+*/
+type ICipher interface {
+
+	// Encrypt method are encrypts message payload.
+	//   - data  a plain message payload.
+	// Returns: encrypted payload or error.
+	Encrypt(data []byte) ([]byte, error)
+
+	// Decrypt method are decrypts message payload.
+	//   - data  an encrypted message payload.
+	// Returns: plain payload or error.
+	Decrypt(data []byte) ([]byte, error)
+}
@@ -35,6 +35,12 @@ type IMessageQueue interface {
 	// Returns: error or nil for success.
 	Send(correlationId string, envelope *MessageEnvelope) error
 
+	// SendBatch method are sends multiple messages into the queue in one operation.
+	//  - correlationId     (optional) transaction id to trace execution through call chain.
+	//  - envelopes         a list of message envelops to be sent.
+	// Returns: error or nil for success.
+	SendBatch(correlationId string, envelopes []*MessageEnvelope) error
+
 	// SendAsObject method are sends an object into the queue.
 	// Before sending the object is converted into JSON string and wrapped in a MessageEnvelop.
 	//  - correlationId     (optional) transaction id to trace execution through call chain.
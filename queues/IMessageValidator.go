@@ -0,0 +1,32 @@
+package queues
+
+/*
+IMessageValidator interface for components that check messages before they are sent to a queue,
+for instance to enforce a schema of message payloads.
+When a validator is referenced by a message queue, Send rejects messages that fail validation
+and returns the validation error without enqueuing them.
+
+Example:
+
+    type MyValidator struct {}
+
+    func (c *MyValidator) ValidateMessage(message *MessageEnvelope) error {
+        if message.MessageType == "order" && !json.Valid(message.Message) {
+            return errors.New("order message shall be a valid JSON")
+        }
+        return nil
+    }
+
+    references := cref.NewReferencesFromTuples(
+        cref.NewDescriptor("mygroup", "validator", "default", "default", "1.0"), &MyValidator{},
+    )
+    queue.SetReferences(references)
+*/
+type IMessageValidator interface {
+
+	// ValidateMessage method are checks a message before it is sent.
+	// The validator shall not change the message.
+	//   - message   a message to be validated.
+	// Returns: validation error or nil if the message is valid.
+	ValidateMessage(message *MessageEnvelope) error
+}
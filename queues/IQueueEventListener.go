@@ -0,0 +1,42 @@
+package queues
+
+// QueueEvent defines a lifecycle event of a message in a queue.
+type QueueEvent string
+
+const (
+	// QueueEventSend is raised after a message is sent to the queue.
+	QueueEventSend QueueEvent = "send"
+	// QueueEventReceive is raised after a message is received from the queue.
+	QueueEventReceive QueueEvent = "receive"
+	// QueueEventComplete is raised after a received message is completed.
+	QueueEventComplete QueueEvent = "complete"
+	// QueueEventAbandon is raised after a received message is returned to the queue.
+	QueueEventAbandon QueueEvent = "abandon"
+	// QueueEventDeadLetter is raised after a message is moved to the dead letter queue.
+	QueueEventDeadLetter QueueEvent = "dead_letter"
+)
+
+/*
+IQueueEventListener interface for components that observe message lifecycle events in a queue,
+for instance to collect metrics or to audit message processing.
+Listeners are called after the queue lock is released, but on the caller's goroutine,
+so they shall return quickly and shall not change the message.
+
+Example:
+
+    type MyEventListener struct {}
+
+    func (c *MyEventListener) OnQueueEvent(event QueueEvent, message *MessageEnvelope) {
+        fmt.Println("Message " + message.MessageId + ": " + string(event))
+    }
+
+    queue := NewMemoryMessageQueue("myqueue")
+    queue.AddEventListener(&MyEventListener{})
+*/
+type IQueueEventListener interface {
+
+	// OnQueueEvent method are notifies the listener about a message lifecycle event.
+	//   - event     a type of the event.
+	//   - message   a message the event relates to.
+	OnQueueEvent(event QueueEvent, message *MessageEnvelope)
+}
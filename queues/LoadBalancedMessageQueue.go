@@ -0,0 +1,469 @@
+package queues
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cauth "github.com/pip-services3-go/pip-services3-components-go/auth"
+	cconn "github.com/pip-services3-go/pip-services3-components-go/connect"
+)
+
+/*
+LoadBalancedMessageQueue Message queue that spreads messages across several child queues.
+Sent messages are distributed between the child queues in round-robin order,
+and received messages are pulled from all of them.
+Received messages shall be completed or abandoned via this queue,
+which passes them to the child queue they came from. The queue remembers received messages
+until they are completed, abandoned or moved to dead letter queue, until their locks expire,
+or until the queue is closed.
+This queue is typically used to test sharded setups.
+
+Configuration parameters:
+
+  - name:                        name of the message queue
+  - receive:
+    - poll_interval:             interval in milliseconds to poll child queues while they are empty (default: 100)
+    - lock_timeout:              lock timeout in milliseconds for messages passed to a listener receiver (default: 30000)
+  - listen:
+    - ack_mode:                  "auto" to complete messages after the receiver returns no error and abandon them otherwise,
+                                 "manual" to leave it to the receiver (default: manual)
+
+References:
+
+- *:logger:*:*:1.0           (optional)  ILogger components to pass log messages
+- *:counters:*:*:1.0         (optional)  ICounters components to pass collected measurements
+
+See MessageQueue
+See MemoryMessageQueue
+
+Example:
+
+    queue := NewLoadBalancedMessageQueue("myqueue",
+        NewMemoryMessageQueue("shard1"), NewMemoryMessageQueue("shard2"))
+    queue.Open("123")
+
+    queue.Send("123", NewMessageEnvelope("", "mymessage", []byte("ABC")))
+    message, err := queue.Receive("123", 10000*time.Millisecond)
+    if message != nil {
+        ...
+        queue.Complete(message)
+    }
+*/
+type LoadBalancedMessageQueue struct {
+	MessageQueue
+	queues        []IMessageQueue
+	owners        map[*MessageEnvelope]*messageOwner
+	nextSend      uint32
+	nextReceive   uint32
+	pollInterval  time.Duration
+	lockTimeout   time.Duration
+	autoAck       bool
+	listeners     int
+	listenStopped *sync.Cond
+	opened        bool
+	cancel        int32
+}
+
+// messageOwner remembers the child queue a message was received from and when its lock expires.
+type messageOwner struct {
+	queue          IMessageQueue
+	lockTimeout    time.Duration
+	expirationTime time.Time
+}
+
+// lockingReceiver is implemented by child queues that can lock a received message
+// for a time different from the time to wait for it.
+type lockingReceiver interface {
+	receiveMatching(correlationId string, waitTimeout time.Duration, lockTimeout time.Duration,
+		predicate func(*MessageEnvelope) bool, dst *MessageEnvelope) (*MessageEnvelope, error)
+}
+
+// NewLoadBalancedMessageQueue method are creates a new instance of the message queue.
+//   - name      (optional) a queue name.
+//   - queues    child queues to spread messages across.
+// Returns: *LoadBalancedMessageQueue
+func NewLoadBalancedMessageQueue(name string, queues ...IMessageQueue) *LoadBalancedMessageQueue {
+	c := LoadBalancedMessageQueue{}
+
+	capabilities := NewMessagingCapabilitiesBuilder().
+		WithMessageCount(true).
+		WithSend(true).
+		WithReceive(true).
+		WithPeek(true).
+		WithPeekBatch(true).
+		WithRenewLock(true).
+		WithAbandon(true).
+		WithDeadLetter(true).
+		Build()
+	c.MessageQueue = *InheritMessageQueue(&c, name, capabilities)
+
+	c.queues = queues
+	c.owners = make(map[*MessageEnvelope]*messageOwner)
+	c.nextSend = 0
+	c.nextReceive = 0
+	c.pollInterval = 100 * time.Millisecond
+	c.lockTimeout = 30000 * time.Millisecond
+	c.autoAck = false
+	c.listenStopped = sync.NewCond(&c.Lock)
+	c.opened = false
+	c.cancel = 0
+
+	return &c
+}
+
+// Configure method are configures component by passing configuration parameters.
+//   - config    configuration parameters to be set.
+func (c *LoadBalancedMessageQueue) Configure(config *cconf.ConfigParams) {
+	c.MessageQueue.Configure(config)
+
+	pollInterval := config.GetAsLongWithDefault("receive.poll_interval", int64(c.pollInterval/time.Millisecond))
+	c.pollInterval = time.Duration(pollInterval) * time.Millisecond
+
+	lockTimeout := config.GetAsLongWithDefault("receive.lock_timeout", int64(c.lockTimeout/time.Millisecond))
+	c.lockTimeout = time.Duration(lockTimeout) * time.Millisecond
+
+	ackMode := config.GetAsStringWithDefault("listen.ack_mode", "")
+	if ackMode != "" {
+		c.autoAck = ackMode == "auto"
+	}
+}
+
+// IsOpen method are checks if the component is opened.
+// Return true if the component has been opened and false otherwise.
+func (c *LoadBalancedMessageQueue) IsOpen() bool {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	return c.opened
+}
+
+// Open method are opens the component and all child queues.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: error or nil no errors occured.
+func (c *LoadBalancedMessageQueue) Open(correlationId string) (err error) {
+	return c.OpenWithParams(correlationId, nil, nil)
+}
+
+// OpenWithParams method are opens the component and all child queues.
+// Connection and credential parameters are not used, since child queues are opened with their own.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - connections       connection parameters
+//   - credential        credential parameters
+// Retruns: error or nil no errors occured.
+func (c *LoadBalancedMessageQueue) OpenWithParams(correlationId string, connections []*cconn.ConnectionParams,
+	credential *cauth.CredentialParams) (err error) {
+	for _, queue := range c.queues {
+		if queue.IsOpen() {
+			continue
+		}
+		err = queue.Open(correlationId)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Lock.Lock()
+	c.opened = true
+	c.Lock.Unlock()
+
+	c.Logger.Trace(correlationId, "Opened queue %s with %d child queues", c.Name(), len(c.queues))
+	return nil
+}
+
+// Close method are closes component and all child queues.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: error or nil no errors occured.
+func (c *LoadBalancedMessageQueue) Close(correlationId string) (err error) {
+	atomic.StoreInt32(&c.cancel, 1)
+
+	c.Lock.Lock()
+	c.opened = false
+	c.owners = make(map[*MessageEnvelope]*messageOwner)
+	c.Lock.Unlock()
+
+	for _, queue := range c.queues {
+		closeErr := queue.Close(correlationId)
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	c.Logger.Trace(correlationId, "Closed queue %s", c.Name())
+	return err
+}
+
+// ReadMessageCount method are reads the current number of messages to be delivered in all child queues.
+// Returns: number of messages or error.
+func (c *LoadBalancedMessageQueue) ReadMessageCount() (count int64, err error) {
+	for _, queue := range c.queues {
+		queueCount, err := queue.ReadMessageCount()
+		if err != nil {
+			return 0, err
+		}
+		count += queueCount
+	}
+	return count, nil
+}
+
+// Send method are sends a message into the next child queue in round-robin order.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - envelope          a message envelop to be sent.
+// Returns: error or nil for success.
+func (c *LoadBalancedMessageQueue) Send(correlationId string, envelope *MessageEnvelope) (err error) {
+	queue, err := c.nextQueue(&c.nextSend)
+	if err != nil {
+		return err
+	}
+	return queue.Send(correlationId, envelope)
+}
+
+// SendBatch method are sends multiple messages spreading them across child queues in round-robin order.
+// Messages that fail to be sent do not prevent other messages from being sent.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - envelopes         a list of message envelops to be sent.
+// Returns: *BatchError with errors of failed messages or nil for success.
+func (c *LoadBalancedMessageQueue) SendBatch(correlationId string, envelopes []*MessageEnvelope) (err error) {
+	errs := make([]error, len(envelopes))
+	failed := 0
+	for index, envelope := range envelopes {
+		errs[index] = c.Send(correlationId, envelope)
+		if errs[index] != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// Peek method are peeks a single incoming message from the child queues without removing it.
+// If there are no messages available in the queues it returns nil.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: a message or error.
+func (c *LoadBalancedMessageQueue) Peek(correlationId string) (result *MessageEnvelope, err error) {
+	for _, queue := range c.queues {
+		result, err = queue.Peek(correlationId)
+		if err != nil || result != nil {
+			return result, err
+		}
+	}
+	return nil, nil
+}
+
+// PeekBatch method are peeks multiple incoming messages from the child queues without removing them.
+// If there are no messages available in the queues it returns an empty list.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - messageCount      a maximum number of messages to peek.
+// Returns: a list with messages or error.
+func (c *LoadBalancedMessageQueue) PeekBatch(correlationId string, messageCount int64) (result []*MessageEnvelope, err error) {
+	result = []*MessageEnvelope{}
+	for _, queue := range c.queues {
+		if (int64)(len(result)) >= messageCount {
+			break
+		}
+		messages, err := queue.PeekBatch(correlationId, messageCount-(int64)(len(result)))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, messages...)
+	}
+	return result, nil
+}
+
+// Receive method are receives an incoming message from any of the child queues and removes it from there.
+// Child queues are polled in round-robin order until a message comes or the timeout expires.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - waitTimeout       a timeout in milliseconds to wait for a message to come.
+// Returns: a message or error.
+func (c *LoadBalancedMessageQueue) Receive(correlationId string, waitTimeout time.Duration) (*MessageEnvelope, error) {
+	return c.receive(correlationId, waitTimeout, waitTimeout)
+}
+
+// RenewLock method are renews a lock on a message in the child queue it was received from.
+//   - message       a message to extend its lock.
+//   - lockTimeout   a locking timeout in milliseconds.
+// Returns: error or nil for success.
+func (c *LoadBalancedMessageQueue) RenewLock(message *MessageEnvelope, lockTimeout time.Duration) (err error) {
+	queue, err := c.ownerQueue(message, false)
+	if err != nil {
+		return err
+	}
+	return queue.RenewLock(message, lockTimeout)
+}
+
+// Complete method are permanently removes a message from the child queue it was received from.
+//   - message   a message to remove.
+// Returns: error or nil for success.
+func (c *LoadBalancedMessageQueue) Complete(message *MessageEnvelope) (err error) {
+	queue, err := c.ownerQueue(message, true)
+	if err != nil {
+		return err
+	}
+	return queue.Complete(message)
+}
+
+// Abandon method are returns a message into the child queue it was received from.
+//   - message   a message to return.
+// Returns: error or nil for success.
+func (c *LoadBalancedMessageQueue) Abandon(message *MessageEnvelope) (err error) {
+	queue, err := c.ownerQueue(message, true)
+	if err != nil {
+		return err
+	}
+	return queue.Abandon(message)
+}
+
+// MoveToDeadLetter method are permanently removes a message from the child queue it was received from
+// and sends it to dead letter queue of that child queue.
+//   - message   a message to be removed.
+// Returns: error or nil for success.
+func (c *LoadBalancedMessageQueue) MoveToDeadLetter(message *MessageEnvelope) (err error) {
+	queue, err := c.ownerQueue(message, true)
+	if err != nil {
+		return err
+	}
+	return queue.MoveToDeadLetter(message)
+}
+
+// Listen method are listens for incoming messages from all child queues
+// and blocks the current thread until listening is ended or the queue is closed.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - receiver          a receiver to receive incoming messages.
+// See IMessageReceiver
+// See Receive
+func (c *LoadBalancedMessageQueue) Listen(correlationId string, receiver IMessageReceiver) error {
+	c.Lock.Lock()
+	c.listeners++
+	c.Lock.Unlock()
+
+	c.Logger.Trace("", "Started listening messages at %s", c.String())
+
+	// Unset cancellation token
+	atomic.StoreInt32(&c.cancel, 0)
+
+	defer func() {
+		c.Lock.Lock()
+		c.listeners--
+		c.listenStopped.Broadcast()
+		c.Lock.Unlock()
+	}()
+
+	receive := func() (*MessageEnvelope, error) {
+		return c.receive(correlationId, c.pollInterval, c.lockTimeout)
+	}
+	c.receiveLoop(correlationId, receiver, receive, &c.cancel, c.pollInterval, c.autoAck)
+
+	c.Logger.Trace("", "Stopped listening messages at %s", c.String())
+	return nil
+}
+
+// EndListen method are ends listening for incoming messages.
+// When this method is call listen unblocks the thread and execution continues.
+// The method returns after the listening loop is stopped,
+// so it shall not be called from inside of a message receiver.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+func (c *LoadBalancedMessageQueue) EndListen(correlationId string) {
+	atomic.StoreInt32(&c.cancel, 1)
+
+	c.Lock.Lock()
+	for c.listeners > 0 {
+		c.listenStopped.Wait()
+	}
+	c.Lock.Unlock()
+}
+
+// receive polls child queues in round-robin order until a message comes or the wait timeout expires.
+// Child queues are tried without waiting, so a child that cannot deliver its messages
+// does not hold back messages available in other children.
+// The received message is locked in its child queue for the lock timeout.
+func (c *LoadBalancedMessageQueue) receive(correlationId string, waitTimeout time.Duration,
+	lockTimeout time.Duration) (*MessageEnvelope, error) {
+	deadline := time.Now().Add(waitTimeout)
+
+	for {
+		for range c.queues {
+			queue, err := c.nextQueue(&c.nextReceive)
+			if err != nil {
+				return nil, err
+			}
+
+			var message *MessageEnvelope
+			if receiver, ok := queue.(lockingReceiver); ok {
+				message, err = receiver.receiveMatching(correlationId, 0, lockTimeout, nil, nil)
+			} else {
+				message, err = queue.Receive(correlationId, 0)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if message != nil {
+				c.addOwner(message, queue, lockTimeout)
+				return message, nil
+			}
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 || atomic.LoadInt32(&c.cancel) != 0 {
+			return nil, nil
+		}
+		if remaining > c.pollInterval {
+			remaining = c.pollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// nextQueue picks the next child queue in round-robin order tracked by the given counter.
+func (c *LoadBalancedMessageQueue) nextQueue(counter *uint32) (IMessageQueue, error) {
+	if len(c.queues) == 0 {
+		return nil, fmt.Errorf("%w: queue %s", ErrNoChildQueues, c.Name())
+	}
+
+	index := atomic.AddUint32(counter, 1) - 1
+	return c.queues[index%uint32(len(c.queues))], nil
+}
+
+// addOwner remembers the child queue the message was received from.
+// Owners of messages with expired locks are forgotten, since their messages
+// were already returned to the child queues.
+func (c *LoadBalancedMessageQueue) addOwner(message *MessageEnvelope, queue IMessageQueue, lockTimeout time.Duration) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	now := time.Now()
+	for received, owner := range c.owners {
+		if !owner.expirationTime.After(now) {
+			delete(c.owners, received)
+		}
+	}
+
+	c.owners[message] = &messageOwner{
+		queue:          queue,
+		lockTimeout:    lockTimeout,
+		expirationTime: now.Add(lockTimeout),
+	}
+}
+
+// ownerQueue finds the child queue the message was received from.
+// When release is true the message is forgotten, since it is going to leave the queue,
+// otherwise the lock expiration time is extended.
+func (c *LoadBalancedMessageQueue) ownerQueue(message *MessageEnvelope, release bool) (IMessageQueue, error) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	owner, ok := c.owners[message]
+	if !ok {
+		return nil, ErrMessageNotReceived
+	}
+	if release {
+		delete(c.owners, message)
+	} else {
+		owner.expirationTime = time.Now().Add(owner.lockTimeout)
+	}
+	return owner.queue, nil
+}
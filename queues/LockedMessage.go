@@ -14,4 +14,7 @@ type LockedMessage struct {
 
 	//The lock timeout in milliseconds.
 	Timeout time.Duration
+
+	// True if the record is reused after the lock is released.
+	reused bool
 }
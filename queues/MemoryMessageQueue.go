@@ -1,22 +1,88 @@
 package queues
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	cauth "github.com/pip-services3-go/pip-services3-components-go/auth"
+	cconn "github.com/pip-services3-go/pip-services3-components-go/connect"
 )
 
 /*
 MemoryMessageQueue Message queue that sends and receives messages within the same process by using shared memory.
 This queue is typically used for testing to mock real queues.
+Messages with the same GroupId are delivered one at a time: the next message of a group
+is not received until the previous one is completed, abandoned or its lock expires,
+while messages of different groups are processed in parallel.
+Within a group messages are delivered by priority and then in the order they were sent,
+in both delivery orders. A delayed message holds back later messages of its group until it becomes visible.
 Configuration parameters:
 
   - name:                        name of the message queue
+  - capacity:                    maximum number of pending messages, 0 for unbounded queue (default: 0)
+  - send:
+    - blocking:                  true to block Send until space is available in a full queue,
+                                 false to return ErrQueueOverflow (default: true)
+    - validate:                  true to reject messages that fail MessageEnvelope.Validate (default: false)
+    - default_message_type:      message type set to sent messages without a type (default: "")
+    - generate_correlation_id:   true to generate correlation ids for sent messages without them (default: false)
+    - invalid_dead_letter:       true to move messages rejected by IMessageValidator to dead letter queue (default: false)
+  - delivery_order:              "fifo" to deliver the oldest message first, "lifo" to deliver the newest message first.
+                                 Messages with higher priority are delivered first in both modes (default: fifo)
+  - max_message_size:            maximum size of message payload in bytes, 0 for no limit (default: 0)
+  - abandon:
+    - preserve_order:            true to return abandoned messages to the head of the queue,
+                                 false to return them to the tail, so they are delivered after other pending messages
+                                 in both delivery orders (default: false)
+  - max_delivery_count:          number of deliveries after which an abandoned message is moved to dead letter queue,
+                                 0 to retry forever (default: 0)
+  - expired:
+    - dead_letter:               true to move expired messages to dead letter queue instead of dropping them (default: false)
+  - dedup:
+    - enabled:                   true to drop messages with MessageId already seen within ttl (default: false)
+    - ttl:                       time in milliseconds to remember sent message ids (default: 60000)
+  - receive:
+    - poll_interval:             interval in milliseconds to poll the queue while it is closed,
+                                 and the longest time a listener waits for a message when max_poll_interval is 0 (default: 1000)
+    - lock_timeout:              lock timeout in milliseconds for messages passed to a listener receiver,
+                                 delivered by Messages or received by TryReceive (default: 30000)
+    - min_poll_interval:         time in milliseconds a listener waits for a message in one receive call
+                                 while messages are flowing (default: 100)
+    - max_poll_interval:         time in milliseconds a listener waits for a message in one receive call
+                                 when the queue stays empty, 0 to use poll_interval (default: 0)
+  - retain:
+    - max_count:                 number of last completed messages retained to be redelivered by Rewind,
+                                 0 to discard completed messages (default: 0)
+  - listen:
+    - ack_mode:                  "auto" to complete messages after the receiver returns no error and abandon them otherwise,
+                                 "manual" to leave it to the receiver (default: manual)
+  - lock:
+    - reaper_interval:           interval in milliseconds to return expired locked messages back to the queue (default: 1000)
+  - depth:
+    - sample_interval:           interval in milliseconds to record the number of pending messages
+                                 as queue.<name>.depth stat, 0 to disable sampling (default: 0)
 
 References:
 
 - *:logger:*:*:1.0           (optional)  ILogger components to pass log messages
 - *:counters:*:*:1.0         (optional)  ICounters components to pass collected measurements
+- *:cipher:*:*:1.0           (optional)  ICipher component to encrypt message payloads inside the queue
+- *:validator:*:*:1.0        (optional)  IMessageValidator component to check messages before they are sent
 
 See MessageQueue
 See MessagingCapabilities
@@ -37,346 +103,2795 @@ type MemoryMessageQueue struct {
 	messages          []MessageEnvelope
 	lockTokenSequence int
 	lockedMessages    map[int]*LockedMessage
+	lockedGroups      map[string]int
+	freeLocks         []*LockedMessage
+	deadLetters       []MessageEnvelope
+	retained          []MessageEnvelope
+	retainMaxCount    int
+	sentCount         int64
+	receivedCount     int64
+	deadCount         int64
+	messageAvailable  *sync.Cond
+	spaceAvailable    *sync.Cond
+	listenStopped     *sync.Cond
+	lockReleased      *sync.Cond
+	listeners         int
+	listening         bool
+	autoAck           bool
+	eventListeners    []IQueueEventListener
+	closeCallback     func(correlationId string, messages []*MessageEnvelope)
+	counterKeys       queueCounterKeys
+	capacity          int
+	sendBlocking      bool
+	maxMessageSize    int
+	validateOnSend    bool
+	validator         IMessageValidator
+	deadLetterInvalid bool
+	defaultType       string
+	generateCorrId    bool
+	maxDeliveryCount  int
+	preserveOrder     bool
+	lifo              bool
+	deadLetterExpired bool
+	hasExpiring       bool
+	dedupEnabled      bool
+	dedupTtl          time.Duration
+	seenMessageIds    map[string]time.Time
+	pollInterval      time.Duration
+	lockTimeout       time.Duration
+	minPollInterval   time.Duration
+	maxPollInterval   time.Duration
+	listenInterval    int64
+	reaperInterval    time.Duration
+	reaperStop        chan struct{}
+	depthInterval     time.Duration
+	depthStop         chan struct{}
+	cipher            ICipher
+	clock             func() time.Time
+	idGenerator       func() string
 	opened            bool
+	draining          bool
 	cancel            int32
 }
 
+// queueNamePattern defines characters allowed in queue names.
+// Dots are not allowed since they separate parts of counter keys.
+var queueNamePattern = regexp.MustCompile("^[A-Za-z0-9_\\-]+$")
+
+// queueCounterKeys keeps names of performance counters of a queue
+// to avoid building them on every operation.
+type queueCounterKeys struct {
+	sent      string
+	received  string
+	dead      string
+	duplicate string
+	expired   string
+	purged    string
+	latency   string
+	depth     string
+}
+
+// newQueueCounterKeys creates names of performance counters for the queue with the given name.
+func newQueueCounterKeys(name string) queueCounterKeys {
+	prefix := "queue." + name
+	return queueCounterKeys{
+		sent:      prefix + ".sent_messages",
+		received:  prefix + ".received_messages",
+		dead:      prefix + ".dead_messages",
+		duplicate: prefix + ".duplicate_messages",
+		expired:   prefix + ".expired_messages",
+		purged:    prefix + ".purged_messages",
+		latency:   prefix + ".message_latency",
+		depth:     prefix + ".depth",
+	}
+}
+
+// maxFreeLocks limits the number of released lock records kept for reuse.
+const maxFreeLocks = 64
+
+// encryptionHeader marks messages with payloads encrypted by the queue cipher.
+const encryptionHeader = "Content-Encryption"
+
 // NewMemoryMessageQueue method are creates a new instance of the message queue.
+// When the name is empty a unique name is generated.
 //   - name  (optional) a queue name.
 // Returns: *MemoryMessageQueue
 // See MessagingCapabilities
+// See NewMemoryMessageQueueWithError
 func NewMemoryMessageQueue(name string) *MemoryMessageQueue {
+	if name == "" {
+		name = "memory-queue-" + cdata.IdGenerator.NextShort()
+	}
+
 	c := MemoryMessageQueue{}
 
-	c.MessageQueue = *InheritMessageQueue(
-		&c, name, NewMessagingCapabilities(true, true, true, true, true, true, true, false, true),
-	)
+	capabilities := NewMessagingCapabilitiesBuilder().
+		WithMessageCount(true).
+		WithSend(true).
+		WithReceive(true).
+		WithPeek(true).
+		WithPeekBatch(true).
+		WithRenewLock(true).
+		WithAbandon(true).
+		WithDeadLetter(true).
+		WithClear(true).
+		Build()
+	c.MessageQueue = *InheritMessageQueue(&c, name, capabilities)
+	c.counterKeys = newQueueCounterKeys(name)
 
 	c.messages = make([]MessageEnvelope, 0)
 	c.lockTokenSequence = 0
 	c.lockedMessages = make(map[int]*LockedMessage, 0)
+	c.lockedGroups = make(map[string]int)
+	c.deadLetters = make([]MessageEnvelope, 0)
+	c.retained = make([]MessageEnvelope, 0)
+	c.retainMaxCount = 0
+	c.messageAvailable = sync.NewCond(&c.Lock)
+	c.spaceAvailable = sync.NewCond(&c.Lock)
+	c.listenStopped = sync.NewCond(&c.Lock)
+	c.lockReleased = sync.NewCond(&c.Lock)
+	c.capacity = 0
+	c.sendBlocking = true
+	c.maxMessageSize = 0
+	c.validateOnSend = false
+	c.deadLetterInvalid = false
+	c.defaultType = ""
+	c.generateCorrId = false
+	c.autoAck = false
+	c.maxDeliveryCount = 0
+	c.preserveOrder = false
+	c.lifo = false
+	c.deadLetterExpired = false
+	c.hasExpiring = false
+	c.dedupEnabled = false
+	c.dedupTtl = 60000 * time.Millisecond
+	c.seenMessageIds = make(map[string]time.Time)
+	c.pollInterval = 1000 * time.Millisecond
+	c.lockTimeout = 30000 * time.Millisecond
+	c.minPollInterval = 100 * time.Millisecond
+	c.maxPollInterval = 0
+	c.listenInterval = 0
+	c.reaperInterval = 1000 * time.Millisecond
+	c.depthInterval = 0
+	c.clock = time.Now
+	c.idGenerator = cdata.IdGenerator.NextLong
 	c.opened = false
+	c.draining = false
 	c.cancel = 0
 
 	return &c
 }
 
-// IsOpen method are checks if the component is opened.
-// Return true if the component has been opened and false otherwise.
-func (c *MemoryMessageQueue) IsOpen() bool {
-	return c.opened
+// NewMemoryMessageQueueWithError method are creates a new instance of the message queue
+// and validates its name. The name may contain only letters, digits, underscores and dashes.
+//   - name  a queue name.
+// Returns: *MemoryMessageQueue or ErrInvalidQueueName if the name is empty or invalid.
+// See NewMemoryMessageQueue
+func NewMemoryMessageQueueWithError(name string) (*MemoryMessageQueue, error) {
+	if !queueNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidQueueName, name)
+	}
+
+	return NewMemoryMessageQueue(name), nil
 }
 
-// OpenWithParams method are opens the component with given connection and credential parameters.
-//   - correlationId     (optional) transaction id to trace execution through call chain.
-//   - connection        connection parameters
-//   - credential        credential parameters
-// Retruns: error or nil no errors occured.
-func (c *MemoryMessageQueue) Open(correlationId string) (err error) {
-	c.opened = true
+// Configure method are configures component by passing configuration parameters.
+//   - config    configuration parameters to be set.
+func (c *MemoryMessageQueue) Configure(config *cconf.ConfigParams) {
+	c.MessageQueue.Configure(config)
+
+	c.capacity = config.GetAsIntegerWithDefault("capacity", c.capacity)
+	c.sendBlocking = config.GetAsBooleanWithDefault("send.blocking", c.sendBlocking)
+	c.maxMessageSize = config.GetAsIntegerWithDefault("max_message_size", c.maxMessageSize)
+	c.validateOnSend = config.GetAsBooleanWithDefault("send.validate", c.validateOnSend)
+	c.deadLetterInvalid = config.GetAsBooleanWithDefault("send.invalid_dead_letter", c.deadLetterInvalid)
+	c.retainMaxCount = config.GetAsIntegerWithDefault("retain.max_count", c.retainMaxCount)
+
+	ackMode := config.GetAsStringWithDefault("listen.ack_mode", "")
+	if ackMode != "" {
+		c.autoAck = ackMode == "auto"
+	}
+	c.defaultType = config.GetAsStringWithDefault("send.default_message_type", c.defaultType)
+	c.generateCorrId = config.GetAsBooleanWithDefault("send.generate_correlation_id", c.generateCorrId)
+	c.maxDeliveryCount = config.GetAsIntegerWithDefault("max_delivery_count", c.maxDeliveryCount)
+	c.preserveOrder = config.GetAsBooleanWithDefault("abandon.preserve_order", c.preserveOrder)
+
+	deliveryOrder := config.GetAsStringWithDefault("delivery_order", "")
+	if deliveryOrder != "" {
+		c.lifo = deliveryOrder == "lifo"
+	}
+	c.deadLetterExpired = config.GetAsBooleanWithDefault("expired.dead_letter", c.deadLetterExpired)
+	c.dedupEnabled = config.GetAsBooleanWithDefault("dedup.enabled", c.dedupEnabled)
 
-	c.Logger.Debug(correlationId, "Opened queue %s", c.Name())
+	dedupTtl := config.GetAsLongWithDefault("dedup.ttl", int64(c.dedupTtl/time.Millisecond))
+	c.dedupTtl = time.Duration(dedupTtl) * time.Millisecond
 
-	return nil
+	pollInterval := config.GetAsLongWithDefault("receive.poll_interval", int64(c.pollInterval/time.Millisecond))
+	c.pollInterval = time.Duration(pollInterval) * time.Millisecond
+
+	lockTimeout := config.GetAsLongWithDefault("receive.lock_timeout", int64(c.lockTimeout/time.Millisecond))
+	c.lockTimeout = time.Duration(lockTimeout) * time.Millisecond
+
+	minPollInterval := config.GetAsLongWithDefault("receive.min_poll_interval", int64(c.minPollInterval/time.Millisecond))
+	c.minPollInterval = time.Duration(minPollInterval) * time.Millisecond
+
+	maxPollInterval := config.GetAsLongWithDefault("receive.max_poll_interval", int64(c.maxPollInterval/time.Millisecond))
+	c.maxPollInterval = time.Duration(maxPollInterval) * time.Millisecond
+
+	reaperInterval := config.GetAsLongWithDefault("lock.reaper_interval", int64(c.reaperInterval/time.Millisecond))
+	c.reaperInterval = time.Duration(reaperInterval) * time.Millisecond
+
+	depthInterval := config.GetAsLongWithDefault("depth.sample_interval", int64(c.depthInterval/time.Millisecond))
+	c.depthInterval = time.Duration(depthInterval) * time.Millisecond
+
+	c.counterKeys = newQueueCounterKeys(c.Name())
 }
 
-// Close method are closes component and frees used resources.
-//   - correlationId 	(optional) transaction id to trace execution through call chain.
-// Returns: error or nil no errors occured.
-func (c *MemoryMessageQueue) Close(correlationId string) (err error) {
-	c.opened = false
-	atomic.StoreInt32(&c.cancel, 1)
+// SetReferences mmethod are sets references to dependent components.
+//   - references 	references to locate the component dependencies.
+func (c *MemoryMessageQueue) SetReferences(references cref.IReferences) {
+	c.MessageQueue.SetReferences(references)
 
-	c.Logger.Debug(correlationId, "Closed queue %s", c.Name())
+	cipher, ok := references.GetOneOptional(
+		cref.NewDescriptor("*", "cipher", "*", "*", "1.0"),
+	).(ICipher)
+	if ok {
+		c.cipher = cipher
+	}
 
-	return nil
+	validator, ok := references.GetOneOptional(
+		cref.NewDescriptor("*", "validator", "*", "*", "1.0"),
+	).(IMessageValidator)
+	if ok {
+		c.validator = validator
+	}
 }
 
-// Clear method are clears component state.
-//   - correlationId 	(optional) transaction id to trace execution through call chain.
-// Returns: error or nil no errors occured.
-func (c *MemoryMessageQueue) Clear(correlationId string) (err error) {
+// SetClock method are sets a time source used to timestamp messages and to expire locks.
+// It is mostly used in tests to control time. The clock shall be set before the queue is used.
+//   - clock   a function that returns the current time, or nil to use time.Now.
+func (c *MemoryMessageQueue) SetClock(clock func() time.Time) {
+	if clock == nil {
+		clock = time.Now
+	}
+	c.clock = clock
+}
+
+// SetIdGenerator method are sets a function that generates ids for sent messages without MessageId.
+// It is mostly used in tests to get reproducible ids. The generator shall be set before the queue is used
+// and shall be safe to call from multiple threads.
+//   - generator   a function that returns a new message id, or nil to use random ids from IdGenerator.
+func (c *MemoryMessageQueue) SetIdGenerator(generator func() string) {
+	if generator == nil {
+		generator = cdata.IdGenerator.NextLong
+	}
+	c.idGenerator = generator
+}
+
+// AddEventListener method are registers a listener to be notified about message lifecycle events:
+// send, receive, complete, abandon and move to dead letter queue.
+//   - listener  a listener to be added.
+// See IQueueEventListener
+func (c *MemoryMessageQueue) AddEventListener(listener IQueueEventListener) {
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
 
-	c.messages = make([]MessageEnvelope, 0)
-	c.lockedMessages = make(map[int]*LockedMessage, 0)
-	atomic.StoreInt32(&c.cancel, 0)
+	// Copy on write to let notifications iterate over listeners without the lock
+	listeners := make([]IQueueEventListener, 0, len(c.eventListeners)+1)
+	listeners = append(listeners, c.eventListeners...)
+	c.eventListeners = append(listeners, listener)
+}
 
-	return nil
+// RemoveEventListener method are unregisters a previously added event listener.
+//   - listener  a listener to be removed.
+func (c *MemoryMessageQueue) RemoveEventListener(listener IQueueEventListener) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	listeners := make([]IQueueEventListener, 0, len(c.eventListeners))
+	for _, l := range c.eventListeners {
+		if l != listener {
+			listeners = append(listeners, l)
+		}
+	}
+	c.eventListeners = listeners
 }
 
-// ReadMessageCount method are reads the current number of messages in the queue to be delivered.
-// Returns: number of messages or error.
-func (c *MemoryMessageQueue) ReadMessageCount() (count int64, err error) {
+// SetCloseCallback method are sets a callback that receives messages left in the queue when it is closed.
+// Leftover messages include messages to be delivered and received messages that are still locked.
+// Regardless of the callback, Close logs a warning with the number of leftover messages.
+//   - callback  a function called with the leftover messages, or nil to remove the callback.
+func (c *MemoryMessageQueue) SetCloseCallback(callback func(correlationId string, messages []*MessageEnvelope)) {
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
 
-	count = (int64)(len(c.messages))
-	return count, nil
+	c.closeCallback = callback
 }
 
-// Send method are sends a message into the queue.
-//   - correlationId     (optional) transaction id to trace execution through call chain.
-//   - envelope          a message envelop to be sent.
-// Returns: error or nil for success.
-func (c *MemoryMessageQueue) Send(correlationId string, envelope *MessageEnvelope) (err error) {
-	envelope.SentTime = time.Now()
+// IsOpen method are checks if the component is opened.
+// Return true if the component has been opened and false otherwise.
+func (c *MemoryMessageQueue) IsOpen() bool {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
 
-	// Add message to the queue
-	c.Lock.Lock()
-	c.messages = append(c.messages, *envelope)
-	c.Lock.Unlock()
+	return c.opened
+}
 
-	c.Counters.IncrementOne("queue." + c.Name() + ".sent_messages")
-	c.Logger.Debug(envelope.CorrelationId, "Sent message %s via %s", envelope.String(), c.Name())
+// Ping method are checks that the queue is alive and ready to send and receive messages.
+// It is a cheap check that does not touch the messages.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: nil if the queue is opened or ErrQueueClosed otherwise.
+func (c *MemoryMessageQueue) Ping(correlationId string) error {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
 
+	if !c.opened {
+		return fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
 	return nil
 }
 
-// Peek meethod are peeks a single incoming message from the queue without removing it.
-// If there are no messages available in the queue it returns nil.
+// Open method are opens the component.
+// Connection and credential parameters are resolved from configuration and references.
+// Unlike other queues, the memory queue can be opened without connection parameters.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: error or nil no errors occured.
+// See OpenWithParams
+func (c *MemoryMessageQueue) Open(correlationId string) (err error) {
+	connections, err := c.ConnectionResolver.ResolveAll(correlationId)
+	if err != nil {
+		return err
+	}
+
+	credential, err := c.CredentialResolver.Lookup(correlationId)
+	if err != nil {
+		return err
+	}
+
+	return c.OpenWithParams(correlationId, connections, credential)
+}
+
+// OpenWithParams method are opens the component with given connection and credential parameters.
+// Connections are optional for the memory queue, but if they are set their protocol must be "memory".
 //   - correlationId     (optional) transaction id to trace execution through call chain.
-// Returns: a message or error.
-func (c *MemoryMessageQueue) Peek(correlationId string) (result *MessageEnvelope, err error) {
-	var message *MessageEnvelope
+//   - connections       connection parameters
+//   - credential        credential parameters
+// Retruns: error or nil no errors occured.
+func (c *MemoryMessageQueue) OpenWithParams(correlationId string, connections []*cconn.ConnectionParams,
+	credential *cauth.CredentialParams) (err error) {
+	for _, connection := range connections {
+		if connection == nil {
+			continue
+		}
+		protocol := connection.Protocol()
+		if protocol != "" && protocol != "memory" {
+			return cerr.NewConfigError(
+				correlationId,
+				"UNSUPPORTED_PROTOCOL",
+				"Protocol "+protocol+" is not supported by memory queue",
+			).WithDetails("protocol", protocol)
+		}
+	}
 
-	// Pick a message
 	c.Lock.Lock()
-	if len(c.messages) > 0 {
-		message = &c.messages[0]
+	if c.opened {
+		c.Lock.Unlock()
+		return cerr.NewInvalidStateError(
+			correlationId,
+			"ALREADY_OPENED",
+			"The queue "+c.Name()+" is already opened",
+		)
 	}
+
+	c.opened = true
+	c.draining = false
+	c.sentCount = 0
+	c.receivedCount = 0
+	c.deadCount = 0
+	c.startLockReaper()
+	c.startDepthSampler()
 	c.Lock.Unlock()
 
-	if message != nil {
-		c.Logger.Trace(message.CorrelationId, "Peeked message %s on %s", message, c.String())
-	}
+	c.Logger.Debug(correlationId, "Opened queue %s", c.Name())
 
-	return message, nil
+	return nil
 }
 
-// PeekBatch method are peeks multiple incoming messages from the queue without removing them.
-// If there are no messages available in the queue it returns an empty list.
-//   - correlationId     (optional) transaction id to trace execution through call chain.
-//   - messageCount      a maximum number of messages to peek.
-// Returns: a list with messages or error.
-func (c *MemoryMessageQueue) PeekBatch(correlationId string, messageCount int64) (result []*MessageEnvelope, err error) {
+// Close method are closes component and frees used resources.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: error or nil no errors occured.
+func (c *MemoryMessageQueue) Close(correlationId string) (err error) {
+	atomic.StoreInt32(&c.cancel, 1)
+
 	c.Lock.Lock()
-	batchMessages := c.messages
-	if messageCount <= (int64)(len(batchMessages)) {
-		batchMessages = batchMessages[0:messageCount]
+	var leftovers []*MessageEnvelope
+	if c.opened {
+		leftovers = c.leftoverMessages()
 	}
+	callback := c.closeCallback
+	c.opened = false
+	c.stopLockReaper()
+	c.stopDepthSampler()
+	// Wake up waiting receivers and senders
+	c.messageAvailable.Broadcast()
+	c.spaceAvailable.Broadcast()
 	c.Lock.Unlock()
 
-	messages := []*MessageEnvelope{}
-	for _, message := range batchMessages {
-		messages = append(messages, &message)
+	if len(leftovers) > 0 {
+		c.Logger.Warn(correlationId, "Closed queue %s with %d undelivered messages", c.Name(), len(leftovers))
+		if callback != nil {
+			callback(correlationId, c.decryptMessages(leftovers))
+		}
 	}
 
-	c.Logger.Trace(correlationId, "Peeked %d messages on %s", len(messages), c.Name())
+	c.Logger.Debug(correlationId, "Closed queue %s", c.Name())
 
-	return messages, nil
+	return nil
 }
 
-//  Receive method are receives an incoming message and removes it from the queue.
-//   - correlationId     (optional) transaction id to trace execution through call chain.
-//   - waitTimeout       a timeout in milliseconds to wait for a message to come.
-// Returns: a message or error.
-func (c *MemoryMessageQueue) Receive(correlationId string, waitTimeout time.Duration) (*MessageEnvelope, error) {
-	messageReceived := false
-	var message *MessageEnvelope
-	elapsedTime := time.Duration(0)
-
-	for elapsedTime < waitTimeout && !messageReceived {
+// CloseGraceful method are stops receiving new messages, waits until all received messages
+// are completed or abandoned, and then closes the component.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+//   - timeout          a timeout to wait for in-flight messages.
+// Returns: error or nil no errors occured. If the timeout elapses the returned error
+// wraps ErrCloseTimeout and contains the number of messages still in flight.
+func (c *MemoryMessageQueue) CloseGraceful(correlationId string, timeout time.Duration) (err error) {
+	// Wake up the waiting process when the timeout expires
+	timer := time.AfterFunc(timeout, func() {
 		c.Lock.Lock()
-		if len(c.messages) == 0 {
-			c.Lock.Unlock()
-			time.Sleep(time.Duration(100) * time.Millisecond)
-			elapsedTime += time.Duration(100)
-			continue
-		}
-
-		// Get message from the queue
-		message = &c.messages[0]
-		c.messages = c.messages[1:]
+		c.lockReleased.Broadcast()
+		c.Lock.Unlock()
+	})
+	defer timer.Stop()
 
-		// Generate and set locked token
-		lockedToken := c.lockTokenSequence
-		c.lockTokenSequence++
-		message.SetReference(lockedToken)
+	deadline := time.Now().Add(timeout)
 
-		// Add messages to locked messages list
-		now := time.Now().Add(waitTimeout)
-		lockedMessage := &LockedMessage{
-			ExpirationTime: now,
-			Message:        message,
-			Timeout:        waitTimeout,
-		}
-		c.lockedMessages[lockedToken] = lockedMessage
+	c.Lock.Lock()
+	// Stop accepting new receives
+	c.draining = true
+	c.messageAvailable.Broadcast()
 
-		messageReceived = true
-		c.Lock.Unlock()
+	for len(c.lockedMessages) > 0 && time.Now().Before(deadline) {
+		c.lockReleased.Wait()
 	}
+	inFlight := len(c.lockedMessages)
+	c.Lock.Unlock()
 
-	if message != nil {
-		c.Counters.IncrementOne("queue." + c.Name() + ".received_messages")
-		c.Logger.Debug(message.CorrelationId, "Received message %s via %s", message, c.Name())
+	err = c.Close(correlationId)
+	if err != nil {
+		return err
 	}
 
-	return message, nil
+	if inFlight > 0 {
+		return fmt.Errorf("%w: %d messages are still in flight", ErrCloseTimeout, inFlight)
+	}
+	return nil
 }
 
-// RenewLock method are renews a lock on a message that makes it invisible from other receivers in the queue.
-// This method is usually used to extend the message processing time.
-//   - message       a message to extend its lock.
-//   - lockTimeout   a locking timeout in milliseconds.
-// Returns:  error or nil for success.
-func (c *MemoryMessageQueue) RenewLock(message *MessageEnvelope, lockTimeout time.Duration) (err error) {
-	reference := message.GetReference()
-	if reference == nil {
-		return nil
-	}
+// Clear method are clears component state.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: error or nil no errors occured.
+// See Purge
+func (c *MemoryMessageQueue) Clear(correlationId string) (err error) {
+	_, err = c.Purge(correlationId)
+	return err
+}
 
+// Purge method are removes all pending, locked and dead letter messages from the queue.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: number of removed messages or error.
+func (c *MemoryMessageQueue) Purge(correlationId string) (count int64, err error) {
 	c.Lock.Lock()
-	// Get message from locked queue
-	lockedToken := reference.(int)
-	lockedMessage, ok := c.lockedMessages[lockedToken]
-	// If lock is found, extend the lock
-	if ok {
-		now := time.Now()
-		// Todo: Shall we skip if the message already expired?
-		if lockedMessage.ExpirationTime.After(now) {
-			lockedMessage.ExpirationTime = now.Add(lockedMessage.Timeout)
-		}
-	}
+	count = (int64)(len(c.messages) + len(c.lockedMessages) + len(c.deadLetters))
+	c.messages = make([]MessageEnvelope, 0)
+	c.lockedMessages = make(map[int]*LockedMessage, 0)
+	c.lockedGroups = make(map[string]int)
+	c.deadLetters = make([]MessageEnvelope, 0)
+	c.retained = make([]MessageEnvelope, 0)
+	c.seenMessageIds = make(map[string]time.Time)
+	c.hasExpiring = false
+	c.spaceAvailable.Broadcast()
+	c.lockReleased.Broadcast()
+	atomic.StoreInt32(&c.cancel, 0)
 	c.Lock.Unlock()
 
-	c.Logger.Trace(message.CorrelationId, "Renewed lock for message %s at %s", message, c.Name())
+	if count > 0 {
+		c.Counters.Increment(c.counterKeys.purged, int(count))
+	}
+	c.Logger.Trace(correlationId, "Purged %d messages at %s", count, c.Name())
 
-	return nil
+	return count, nil
 }
 
-// Complete method are permanently removes a message from the queue.
-// This method is usually used to remove the message after successful processing.
-//   - message   a message to remove.
-// Returns: error or nil for success.
-func (c *MemoryMessageQueue) Complete(message *MessageEnvelope) (err error) {
-	reference := message.GetReference()
-	if reference == nil {
-		return nil
-	}
-
+// Drain method are removes all pending messages from the queue and returns them
+// in the order they would be received. Locked messages are not affected.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: removed messages or error.
+func (c *MemoryMessageQueue) Drain(correlationId string) (result []MessageEnvelope, err error) {
 	c.Lock.Lock()
-	lockedToken := reference.(int)
-	delete(c.lockedMessages, lockedToken)
-	message.SetReference(nil)
+	expired := c.discardExpiredMessages()
+	messages := c.messages
+	c.messages = make([]MessageEnvelope, 0)
+	c.spaceAvailable.Broadcast()
 	c.Lock.Unlock()
 
-	c.Logger.Trace(message.CorrelationId, "Completed message %s at %s", message, c.Name())
+	c.countExpiredMessages(correlationId, expired)
 
-	return nil
+	result = make([]MessageEnvelope, 0, len(messages))
+	for index := range messages {
+		message, err := c.decryptMessage(&messages[index])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *message)
+	}
+
+	c.Logger.Trace(correlationId, "Drained %d messages from %s", len(result), c.Name())
+
+	return result, nil
 }
 
-// Abandon method are returnes message into the queue and makes it available for all subscribers to receive it again.
-// This method is usually used to return a message which could not be processed at the moment
-// to repeat the attempt. Messages that cause unrecoverable errors shall be removed permanently
-// or/and send to dead letter queue.
-//   - message   a message to return.
-// Returns: error or nil for success.
-func (c *MemoryMessageQueue) Abandon(message *MessageEnvelope) (err error) {
-	reference := message.GetReference()
-	if reference == nil {
-		return nil
+// ContainsMessageId method are checks if a message with the given id is pending or locked in the queue.
+// It can be used by producers to avoid sending the same message twice.
+//   - messageId         a message id to look for.
+// Returns: true if the message is in the queue, or error.
+func (c *MemoryMessageQueue) ContainsMessageId(messageId string) (bool, error) {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	for index := range c.messages {
+		if c.messages[index].MessageId == messageId {
+			return true, nil
+		}
+	}
+	for _, lockedMessage := range c.lockedMessages {
+		if lockedMessage.Message.MessageId == messageId {
+			return true, nil
+		}
 	}
+	return false, nil
+}
 
+// PromoteMessage method are moves a pending message with the given id to the head of the queue,
+// so it is delivered next regardless of its priority. A delayed message keeps its delay
+// and is delivered first once it becomes visible.
+// Messages with higher priority sent later still go ahead of the promoted message.
+//   - messageId         an id of the message to promote.
+// Returns: true if the message was found among pending messages, or error.
+func (c *MemoryMessageQueue) PromoteMessage(messageId string) (bool, error) {
 	c.Lock.Lock()
-	// Get message from locked queue
-	lockedToken := reference.(int)
-	lockedMessage, ok := c.lockedMessages[lockedToken]
-	if ok {
-		// Remove from locked messages
-		delete(c.lockedMessages, lockedToken)
-		message.SetReference(nil)
+	if !c.opened {
+		c.Lock.Unlock()
+		return false, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
 
-		// Skip if it is already expired
-		if lockedMessage.ExpirationTime.Before(time.Now()) {
-			c.Lock.Unlock()
-			return nil
+	index := -1
+	for i := range c.messages {
+		if c.messages[i].MessageId == messageId {
+			index = i
+			break
 		}
-	} else { // Skip if it absent
+	}
+	if index < 0 {
 		c.Lock.Unlock()
-		return nil
+		return false, nil
 	}
+
+	message := c.removeMessage(index)
+	c.insertMessage(0, message)
+	c.messageAvailable.Broadcast()
 	c.Lock.Unlock()
 
-	c.Logger.Trace(message.CorrelationId, "Abandoned message %s at %s", message, c.Name())
+	c.Logger.Debug(message.CorrelationId, "Promoted message %s at %s", messageId, c.Name())
 
-	// Add back to message queue
-	return c.Send(message.CorrelationId, message)
+	return true, nil
 }
 
-// MoveToDeadLetter method are permanently removes a message from the queue and sends it to dead letter queue.
-//   - message   a message to be removed.
-// Returns: error or nil for success.
-func (c *MemoryMessageQueue) MoveToDeadLetter(message *MessageEnvelope) (err error) {
-	reference := message.GetReference()
-	if reference == nil {
-		return nil
-	}
+// ReadMessageCount method are reads the current number of messages in the queue to be delivered.
+// Returns: number of messages or error.
+func (c *MemoryMessageQueue) ReadMessageCount() (count int64, err error) {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
 
-	c.Lock.Lock()
-	lockedToken := reference.(int)
-	delete(c.lockedMessages, lockedToken)
-	message.SetReference(nil)
-	c.Lock.Unlock()
+	count = (int64)(len(c.messages))
+	return count, nil
+}
 
-	c.Counters.IncrementOne("queue." + c.Name() + ".dead_messages")
-	c.Logger.Trace(message.CorrelationId, "Moved to dead message %s at %s", message, c.Name())
+// ReadQueueByteSize method are reads an estimated size in bytes of messages in the queue to be delivered.
+// Returns: size of messages in bytes or error.
+// See MessageEnvelope.Size
+func (c *MemoryMessageQueue) ReadQueueByteSize() (size int64, err error) {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
 
-	return nil
+	for index := range c.messages {
+		size += (int64)(c.messages[index].Size())
+	}
+	return size, nil
 }
 
-// Listen method are listens for incoming messages and blocks the current thread until queue is closed.
-//   - correlationId     (optional) transaction id to trace execution through call chain.
-//   - receiver          a receiver to receive incoming messages.
-// See IMessageReceiver
-// See Receive
-func (c *MemoryMessageQueue) Listen(correlationId string, receiver IMessageReceiver) error {
-	c.Logger.Trace("", "Started listening messages at %s", c.String())
+// ReadLockedMessageCount method are reads the current number of messages that were received
+// and are locked until they are completed or abandoned.
+// Returns: number of messages or error.
+func (c *MemoryMessageQueue) ReadLockedMessageCount() (count int64, err error) {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
 
-	// Unset cancellation token
-	atomic.StoreInt32(&c.cancel, 0)
+	count = (int64)(len(c.lockedMessages))
+	return count, nil
+}
 
-	for atomic.LoadInt32(&c.cancel) == 0 {
-		message, err := c.Receive(correlationId, time.Duration(1000)*time.Millisecond)
+// ReadTotalMessageCount method are reads the total number of messages in the queue
+// including messages to be delivered and locked messages that are being processed.
+// Returns: number of messages or error.
+func (c *MemoryMessageQueue) ReadTotalMessageCount() (count int64, err error) {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	count = (int64)(len(c.messages) + len(c.lockedMessages))
+	return count, nil
+}
+
+// GetStats method are gets the current queue statistics.
+// Returns: QueueStats with message counts.
+func (c *MemoryMessageQueue) GetStats() QueueStats {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	return QueueStats{
+		PendingCount:  (int64)(len(c.messages)),
+		LockedCount:   (int64)(len(c.lockedMessages)),
+		DeadCount:     (int64)(len(c.deadLetters)),
+		TotalSent:     c.sentCount,
+		TotalReceived: c.receivedCount,
+		TotalDead:     c.deadCount,
+	}
+}
+
+// Snapshot method are takes a consistent copy of pending, locked and dead letter messages.
+// All messages are copied under a single lock, so the snapshot does not change any state of the queue.
+// Returns: QueueSnapshot with copies of the messages.
+func (c *MemoryMessageQueue) Snapshot() QueueSnapshot {
+	c.Lock.RLock()
+	snapshot := QueueSnapshot{
+		Time:           c.clock(),
+		Messages:       make([]*MessageEnvelope, 0, len(c.messages)),
+		LockedMessages: make([]*LockedMessageSnapshot, 0, len(c.lockedMessages)),
+		DeadLetters:    make([]*MessageEnvelope, 0, len(c.deadLetters)),
+	}
+	for index := range c.messages {
+		snapshot.Messages = append(snapshot.Messages, c.messages[index].Clone())
+	}
+	for token, lockedMessage := range c.lockedMessages {
+		snapshot.LockedMessages = append(snapshot.LockedMessages, &LockedMessageSnapshot{
+			LockToken:      token,
+			Message:        lockedMessage.Message.Clone(),
+			ExpirationTime: lockedMessage.ExpirationTime,
+		})
+	}
+	for index := range c.deadLetters {
+		snapshot.DeadLetters = append(snapshot.DeadLetters, c.deadLetters[index].Clone())
+	}
+	c.Lock.RUnlock()
+
+	sort.Slice(snapshot.LockedMessages, func(i, j int) bool {
+		return snapshot.LockedMessages[i].LockToken < snapshot.LockedMessages[j].LockToken
+	})
+
+	c.decryptMessages(snapshot.Messages)
+	c.decryptMessages(snapshot.DeadLetters)
+	for _, locked := range snapshot.LockedMessages {
+		if message, err := c.decryptMessage(locked.Message); err == nil {
+			locked.Message = message
+		}
+	}
+
+	return snapshot
+}
+
+// Send method are sends a message into the queue.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - envelope          a message envelop to be sent.
+// Returns: error or nil for success.
+func (c *MemoryMessageQueue) Send(correlationId string, envelope *MessageEnvelope) (err error) {
+	return c.SendDelayed(correlationId, envelope, 0)
+}
+
+// SendDelayed method are sends a message into the queue that becomes visible to receivers only after the delay.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - envelope          a message envelop to be sent.
+//   - delay             a time to keep the message invisible.
+// Returns: error or nil for success.
+func (c *MemoryMessageQueue) SendDelayed(correlationId string, envelope *MessageEnvelope, delay time.Duration) (err error) {
+	return c.sendMessage(correlationId, envelope, delay, 0)
+}
+
+// SendWithTimeout method are sends a message into the queue and waits up to the timeout
+// for space to become available in a full bounded queue.
+// The method waits for space even when the queue is configured for non-blocking sends.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - envelope          a message envelop to be sent.
+//   - timeout           a time to wait for space in the queue.
+// Returns: error or nil for success, or ErrSendTimeout if no space became available within the timeout.
+func (c *MemoryMessageQueue) SendWithTimeout(correlationId string, envelope *MessageEnvelope, timeout time.Duration) (err error) {
+	return c.sendMessage(correlationId, envelope, 0, timeout)
+}
+
+// sendMessage sends a message into the queue.
+// Positive timeout limits the time to wait for space in a bounded queue.
+func (c *MemoryMessageQueue) sendMessage(correlationId string, envelope *MessageEnvelope,
+	delay time.Duration, timeout time.Duration) (err error) {
+	c.stampMessage(envelope)
+
+	err = c.checkMessage(envelope)
+	if err != nil {
+		return err
+	}
+
+	envelope.SentTime = c.clock()
+
+	message := *envelope
+	if delay > 0 {
+		message.visibleTime = envelope.SentTime.Add(delay)
+	}
+	err = c.encryptMessage(&message)
+	if err != nil {
+		return err
+	}
+
+	// Add message to the queue
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	duplicate := c.isDuplicate(&message)
+	if !duplicate {
+		err = c.waitForSpace(timeout)
 		if err != nil {
-			c.Logger.Error(correlationId, err, "Failed to receive the message")
-		}
-
-		if message != nil && atomic.LoadInt32(&c.cancel) == 0 {
-			// Todo: shall we recover after panic here??
-			func(message *MessageEnvelope) {
-				defer func() {
-					if r := recover(); r != nil {
-						err := fmt.Sprintf("%v", r)
-						c.Logger.Error(correlationId, nil, "Failed to process the message - "+err)
-					}
-				}()
-
-				err = receiver.ReceiveMessage(message, c)
-				if err != nil {
-					c.Logger.Error(correlationId, err, "Failed to process the message")
-				}
-			}(message)
+			c.Lock.Unlock()
+			return err
 		}
+		// The lock is released while waiting for space,
+		// so the same message could be sent by another thread
+		duplicate = c.isDuplicate(&message)
+	}
+	if duplicate {
+		c.Lock.Unlock()
+
+		c.Counters.IncrementOne(c.counterKeys.duplicate)
+		c.Logger.Debug(envelope.CorrelationId, "Dropped duplicate message %s via %s", envelope.String(), c.Name())
+
+		return nil
+	}
+	c.rememberMessageId(&message)
+	c.pushMessage(message)
+	c.sentCount++
+	c.messageAvailable.Broadcast()
+	c.Lock.Unlock()
+
+	if delay > 0 {
+		c.notifyWhenVisible(delay)
 	}
 
+	c.Counters.IncrementOne(c.counterKeys.sent)
+	c.Logger.Debug(envelope.CorrelationId, "Sent message %s via %s", envelope.String(), c.Name())
+	c.notifyEvent(QueueEventSend, envelope)
+
 	return nil
 }
 
-// EndListen method are ends listening for incoming messages.
-// When c method is call listen unblocks the thread and execution continues.
+// SendBatch method are sends multiple messages into the queue in one operation.
+// All messages are validated before any of them is sent. When the queue runs out of space
+// in the middle of the batch, the messages sent so far stay in the queue.
 //   - correlationId     (optional) transaction id to trace execution through call chain.
-func (c *MemoryMessageQueue) EndListen(correlationId string) {
-	atomic.StoreInt32(&c.cancel, 1)
+//   - envelopes         a list of message envelops to be sent.
+// Returns: error or nil for success, or *BatchError with nil for sent messages
+// and errors for messages that were not sent when the batch was sent partially.
+func (c *MemoryMessageQueue) SendBatch(correlationId string, envelopes []*MessageEnvelope) (err error) {
+	if len(envelopes) == 0 {
+		return nil
+	}
+
+	sentTime := c.clock()
+
+	for _, envelope := range envelopes {
+		c.stampMessage(envelope)
+
+		err = c.checkMessage(envelope)
+		if err != nil {
+			return err
+		}
+	}
+
+	messages := make([]MessageEnvelope, len(envelopes))
+	for index, envelope := range envelopes {
+		envelope.SentTime = sentTime
+		messages[index] = *envelope
+		err = c.encryptMessage(&messages[index])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Add messages to the queue
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	sent := 0
+	duplicates := 0
+	sentEnvelopes := make([]*MessageEnvelope, 0, len(messages))
+	var errs []error
+	for index := range messages {
+		if c.isDuplicate(&messages[index]) {
+			duplicates++
+			continue
+		}
+		err = c.waitForSpace(0)
+		if err != nil {
+			// Messages from this one on are not sent
+			errs = make([]error, len(messages))
+			for failed := index; failed < len(messages); failed++ {
+				errs[failed] = err
+			}
+			break
+		}
+		if c.isDuplicate(&messages[index]) {
+			duplicates++
+			continue
+		}
+		c.rememberMessageId(&messages[index])
+		c.pushMessage(messages[index])
+		c.sentCount++
+		sent++
+		sentEnvelopes = append(sentEnvelopes, envelopes[index])
+		c.messageAvailable.Broadcast()
+	}
+	c.Lock.Unlock()
+
+	c.notifyEvent(QueueEventSend, sentEnvelopes...)
+
+	if duplicates > 0 {
+		c.Counters.Increment(c.counterKeys.duplicate, duplicates)
+	}
+	c.Counters.Increment(c.counterKeys.sent, sent)
+	c.Logger.Debug(correlationId, "Sent %d messages via %s", sent, c.Name())
+
+	if errs != nil {
+		return &BatchError{Errors: errs}
+	}
+
+	return nil
+}
+
+// Peek meethod are peeks a single incoming message from the queue without removing it.
+// If there are no messages available in the queue it returns nil.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: a message or error.
+func (c *MemoryMessageQueue) Peek(correlationId string) (result *MessageEnvelope, err error) {
+	return c.PeekBy(correlationId, nil)
+}
+
+// PeekBy method are peeks the first incoming message that matches the predicate without removing it.
+// If there are no matching messages available in the queue it returns nil.
+// Expired messages are discarded from the queue.
+// Messages held back by their group are skipped, since they cannot be received yet.
+// The predicate is called under the queue lock for stored messages,
+// so it shall not call the queue and shall not change the messages.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - predicate         a function that returns true for the message to be peeked.
+// Returns: a message or error.
+func (c *MemoryMessageQueue) PeekBy(correlationId string, predicate func(*MessageEnvelope) bool) (result *MessageEnvelope, err error) {
+	var message *MessageEnvelope
+
+	// Pick a message
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return nil, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	expired := c.discardExpiredMessages()
+	index := c.nextReceivableIndex(c.clock(), predicate)
+	if index >= 0 {
+		peeked := c.messages[index]
+		message = &peeked
+	}
+	c.Lock.Unlock()
+
+	c.countExpiredMessages(correlationId, expired)
+
+	if message != nil {
+		message, err = c.decryptMessage(message)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Logger.Trace(message.CorrelationId, "Peeked message %s on %s", message, c.String())
+	}
+
+	return message, nil
+}
+
+// PeekBatch method are peeks multiple incoming messages from the queue without removing them.
+// If there are no messages available in the queue it returns an empty list.
+// Returned messages are copies that can be changed without affecting the queue.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - messageCount      a maximum number of messages to peek.
+// Returns: a list with messages or error.
+// See PeekBatchRefs
+func (c *MemoryMessageQueue) PeekBatch(correlationId string, messageCount int64) (result []*MessageEnvelope, err error) {
+	return c.peekBatch(correlationId, messageCount, true)
+}
+
+// PeekBatchRefs method are peeks multiple incoming messages from the queue without removing them
+// and without copying their payloads and headers.
+// Returned messages share payload buffers and headers with messages stored in the queue,
+// so callers must not change them.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - messageCount      a maximum number of messages to peek.
+// Returns: a list with messages or error.
+// See PeekBatch
+func (c *MemoryMessageQueue) PeekBatchRefs(correlationId string, messageCount int64) (result []*MessageEnvelope, err error) {
+	return c.peekBatch(correlationId, messageCount, false)
+}
+
+// peekBatch peeks visible messages and optionally makes deep copies of them.
+func (c *MemoryMessageQueue) peekBatch(correlationId string, messageCount int64, clone bool) ([]*MessageEnvelope, error) {
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return nil, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	expired := c.discardExpiredMessages()
+	now := c.clock()
+	messages := []*MessageEnvelope{}
+	for index := range c.messages {
+		if (int64)(len(messages)) >= messageCount {
+			break
+		}
+		if !c.isMessageVisible(&c.messages[index], now) {
+			continue
+		}
+		var message *MessageEnvelope
+		if clone {
+			message = c.messages[index].Clone()
+		} else {
+			peeked := c.messages[index]
+			message = &peeked
+		}
+		messages = append(messages, message)
+	}
+	c.Lock.Unlock()
+
+	c.countExpiredMessages(correlationId, expired)
+
+	for index := range messages {
+		message, err := c.decryptMessage(messages[index])
+		if err != nil {
+			return nil, err
+		}
+		messages[index] = message
+	}
+
+	c.Logger.Trace(correlationId, "Peeked %d messages on %s", len(messages), c.Name())
+
+	return messages, nil
+}
+
+//  Receive method are receives an incoming message and removes it from the queue.
+// When the queue is closed while waiting, the method returns without a message.
+// The message is locked for the wait timeout, or for receive.lock_timeout when the timeout is zero.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - waitTimeout       a timeout in milliseconds to wait for a message to come.
+// Returns: a message or error.
+func (c *MemoryMessageQueue) Receive(correlationId string, waitTimeout time.Duration) (*MessageEnvelope, error) {
+	return c.receiveMatching(correlationId, waitTimeout, waitTimeout, nil, nil)
+}
+
+// ReceiveInto method are receives an incoming message, removes it from the queue
+// and copies its fields into the provided envelope.
+// It allows consumers to reuse one envelope for many messages: the envelope is filled under the queue lock
+// and the queue keeps its locked copy in a record reused by the next receive, so no envelopes are allocated.
+// The lock reference is copied as well, so the envelope can be completed or abandoned
+// until it is reused for the next message.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - dst               an envelope to copy the received message into.
+//   - waitTimeout       a timeout in milliseconds to wait for a message to come.
+// Returns: true if a message was received, false if no message came within the timeout, or error.
+func (c *MemoryMessageQueue) ReceiveInto(correlationId string, dst *MessageEnvelope,
+	waitTimeout time.Duration) (bool, error) {
+	message, err := c.receiveMatching(correlationId, waitTimeout, waitTimeout, nil, dst)
+	if err != nil || message == nil {
+		return false, err
+	}
+
+	// Decrypted messages are copies that shall be moved into the provided envelope
+	if message != dst {
+		*dst = *message
+	}
+	return true, nil
+}
+
+// ReceiveReply method are receives the next message with the given correlation id and removes it from the queue.
+// Messages with other correlation ids are left in the queue for other receivers.
+// It is usually used to wait for a reply in request/response communication.
+//   - correlationId     a correlation id of the expected reply.
+//   - waitTimeout       a timeout in milliseconds to wait for the reply to come.
+// Returns: a reply message, nil if it did not come within the timeout, or error.
+func (c *MemoryMessageQueue) ReceiveReply(correlationId string, waitTimeout time.Duration) (*MessageEnvelope, error) {
+	return c.receiveMatching(correlationId, waitTimeout, waitTimeout, func(message *MessageEnvelope) bool {
+		return message.CorrelationId == correlationId
+	}, nil)
+}
+
+// receiveMatching receives the first visible message that matches the predicate.
+// Nil predicate matches all messages. When dst is set the message is copied into it
+// and the queue keeps the locked message in a reusable record.
+func (c *MemoryMessageQueue) receiveMatching(correlationId string, waitTimeout time.Duration,
+	lockTimeout time.Duration, predicate func(*MessageEnvelope) bool, dst *MessageEnvelope) (*MessageEnvelope, error) {
+	var message *MessageEnvelope
+	var timer *time.Timer
+
+	deadline := time.Now().Add(waitTimeout)
+
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return nil, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	expired := c.discardExpiredMessages()
+	index := c.nextReceivableIndex(c.clock(), predicate)
+	for (index < 0 || c.draining) && !c.isClosed() && time.Now().Before(deadline) {
+		// Wake up the waiting receiver when the timeout expires.
+		// The timer is started only when the receiver has to wait.
+		if timer == nil {
+			timer = time.AfterFunc(time.Until(deadline), func() {
+				c.Lock.Lock()
+				c.messageAvailable.Broadcast()
+				c.Lock.Unlock()
+			})
+			defer timer.Stop()
+		}
+		c.messageAvailable.Wait()
+		expired += c.discardExpiredMessages()
+		index = c.nextReceivableIndex(c.clock(), predicate)
+	}
+
+	if index >= 0 && !c.draining {
+		if dst != nil {
+			message = c.lockMessageInto(index, lockTimeout, dst)
+		} else {
+			message = c.lockMessage(index, lockTimeout)
+		}
+	}
+	c.Lock.Unlock()
+
+	c.countExpiredMessages(correlationId, expired)
+
+	return c.deliverMessage(message)
+}
+
+// TryReceive method are receives an incoming message and removes it from the queue without waiting.
+// The received message is locked for the configured receive lock timeout.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: a message, nil if the queue is empty, or error.
+func (c *MemoryMessageQueue) TryReceive(correlationId string) (*MessageEnvelope, error) {
+	var message *MessageEnvelope
+
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return nil, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	expired := c.discardExpiredMessages()
+	index := c.nextReceivableIndex(c.clock(), nil)
+	if index >= 0 && !c.draining {
+		message = c.lockMessage(index, c.lockTimeout)
+	}
+	c.Lock.Unlock()
+
+	c.countExpiredMessages(correlationId, expired)
+
+	return c.deliverMessage(message)
+}
+
+// notifyEvent passes the event to registered event listeners. Must be called without the lock.
+func (c *MemoryMessageQueue) notifyEvent(event QueueEvent, messages ...*MessageEnvelope) {
+	c.Lock.RLock()
+	listeners := c.eventListeners
+	c.Lock.RUnlock()
+
+	for _, listener := range listeners {
+		for _, message := range messages {
+			listener.OnQueueEvent(event, message)
+		}
+	}
+}
+
+// deliverMessage decrypts the locked message and records receive statistics.
+func (c *MemoryMessageQueue) deliverMessage(message *MessageEnvelope) (*MessageEnvelope, error) {
+	if message == nil {
+		return nil, nil
+	}
+
+	message, err := c.decryptMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Counters.IncrementOne(c.counterKeys.received)
+	c.recordLatency(message)
+	c.Logger.Debug(message.CorrelationId, "Received message %s via %s", message, c.Name())
+	c.notifyEvent(QueueEventReceive, message)
+
+	return message, nil
+}
+
+// ReceiveBatch method are receives multiple incoming messages and removes them from the queue in one operation.
+// The method waits until at least one message is available or the timeout expires.
+// Each received message gets its own lock and shall be completed or abandoned individually.
+// Messages are locked for the wait timeout, or for receive.lock_timeout when the timeout is zero.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - maxCount          a maximum number of messages to receive.
+//   - waitTimeout       a timeout in milliseconds to wait for a message to come.
+// Returns: a list of received messages or error.
+func (c *MemoryMessageQueue) ReceiveBatch(correlationId string, maxCount int,
+	waitTimeout time.Duration) ([]*MessageEnvelope, error) {
+	messages := make([]*MessageEnvelope, 0)
+
+	// Wake up the waiting receiver when the timeout expires
+	timer := time.AfterFunc(waitTimeout, func() {
+		c.Lock.Lock()
+		c.messageAvailable.Broadcast()
+		c.Lock.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(waitTimeout)
+
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return nil, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	expired := c.discardExpiredMessages()
+	index := c.nextReceivableIndex(c.clock(), nil)
+	for (index < 0 || c.draining) && !c.isClosed() && time.Now().Before(deadline) {
+		c.messageAvailable.Wait()
+		expired += c.discardExpiredMessages()
+		index = c.nextReceivableIndex(c.clock(), nil)
+	}
+
+	for index >= 0 && !c.draining && len(messages) < maxCount {
+		messages = append(messages, c.lockMessage(index, waitTimeout))
+		index = c.nextReceivableIndex(c.clock(), nil)
+	}
+	c.Lock.Unlock()
+
+	c.countExpiredMessages(correlationId, expired)
+
+	for index := range messages {
+		message, err := c.decryptMessage(messages[index])
+		if err != nil {
+			return nil, err
+		}
+		messages[index] = message
+	}
+
+	if len(messages) > 0 {
+		c.Counters.Increment(c.counterKeys.received, len(messages))
+		for _, message := range messages {
+			c.recordLatency(message)
+		}
+		c.Logger.Debug(correlationId, "Received %d messages via %s", len(messages), c.Name())
+		c.notifyEvent(QueueEventReceive, messages...)
+	}
+
+	return messages, nil
+}
+
+// GetLockToken method are gets the lock token of a received message.
+// The token can be stored externally and later set into a message envelope
+// via SetReference to complete or abandon the message.
+//   - message   a received message.
+// Returns: the lock token and true if the message is currently locked, or false otherwise.
+func (c *MemoryMessageQueue) GetLockToken(message *MessageEnvelope) (int, bool) {
+	if message == nil {
+		return 0, false
+	}
+
+	lockedToken, ok := message.GetReference().(int)
+	if !ok {
+		return 0, false
+	}
+
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	_, ok = c.lockedMessages[lockedToken]
+	return lockedToken, ok
+}
+
+// RenewLock method are renews a lock on a message that makes it invisible from other receivers in the queue.
+// This method is usually used to extend the message processing time.
+//   - message       a message to extend its lock.
+//   - lockTimeout   a locking timeout in milliseconds.
+// Returns:  error or nil for success.
+func (c *MemoryMessageQueue) RenewLock(message *MessageEnvelope, lockTimeout time.Duration) (err error) {
+	c.Lock.Lock()
+	// Get message from locked queue
+	lockedToken, lockedMessage, err := c.findLockedMessage(message)
+	if err != nil {
+		if errors.Is(err, ErrLockExpired) {
+			c.requeueExpiredLock(lockedToken, lockedMessage, message)
+		}
+		c.Lock.Unlock()
+		return err
+	}
+
+	// Extend the lock
+	lockedMessage.ExpirationTime = c.clock().Add(lockedMessage.Timeout)
+	c.Lock.Unlock()
+
+	c.Logger.Trace(message.CorrelationId, "Renewed lock for message %s at %s", message, c.Name())
+
+	return nil
+}
+
+// Complete method are permanently removes a message from the queue.
+// This method is usually used to remove the message after successful processing.
+// The message is identified by its lock token, so it can be any envelope
+// that carries the token returned by GetLockToken in its reference.
+//   - message   a message to remove.
+// Returns: error or nil for success.
+func (c *MemoryMessageQueue) Complete(message *MessageEnvelope) (err error) {
+	c.Lock.Lock()
+	err = c.completeMessage(message)
+	c.Lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Trace(message.CorrelationId, "Completed message %s at %s", message, c.Name())
+	c.notifyEvent(QueueEventComplete, message)
+
+	return nil
+}
+
+// Abandon method are returnes message into the queue and makes it available for all subscribers to receive it again.
+// This method is usually used to return a message which could not be processed at the moment
+// to repeat the attempt. Messages that cause unrecoverable errors shall be removed permanently
+// or/and send to dead letter queue. Like Complete, the message is identified by its lock token.
+//   - message   a message to return.
+// Returns: error or nil for success.
+func (c *MemoryMessageQueue) Abandon(message *MessageEnvelope) (err error) {
+	return c.AbandonWithDelay(message, 0)
+}
+
+// AbandonWithDelay method are returnes message into the queue and keeps it invisible for receivers
+// until the delay elapses. This method is usually used to retry processing with a backoff
+// after transient failures.
+//   - message   a message to return.
+//   - delay     a time to wait before the message becomes available again.
+// Returns: error or nil for success.
+// See Abandon
+func (c *MemoryMessageQueue) AbandonWithDelay(message *MessageEnvelope, delay time.Duration) (err error) {
+	c.Lock.Lock()
+	dead, err := c.abandonMessage(message, delay)
+	c.Lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if dead {
+		c.Counters.IncrementOne(c.counterKeys.dead)
+		c.Logger.Trace(message.CorrelationId, "Moved to dead message %s at %s after %d deliveries",
+			message, c.Name(), message.DeliveryCount)
+		c.notifyEvent(QueueEventDeadLetter, message)
+		return nil
+	}
+
+	if delay > 0 {
+		c.notifyWhenVisible(delay)
+	}
+
+	c.Logger.Trace(message.CorrelationId, "Abandoned message %s at %s", message, c.Name())
+	c.notifyEvent(QueueEventAbandon, message)
+
+	return nil
+}
+
+// CompleteBatch method are permanently removes multiple messages from the queue in one operation.
+// Messages that fail to complete do not prevent other messages from being completed.
+//   - messages  a list of messages to remove.
+// Returns: *BatchError with errors of failed messages or nil for success.
+// See Complete
+func (c *MemoryMessageQueue) CompleteBatch(messages []*MessageEnvelope) (err error) {
+	errs := make([]error, len(messages))
+	failed := 0
+
+	c.Lock.Lock()
+	for index, message := range messages {
+		errs[index] = c.completeMessage(message)
+		if errs[index] != nil {
+			failed++
+		}
+	}
+	c.Lock.Unlock()
+
+	c.Logger.Trace("", "Completed %d messages at %s", len(messages)-failed, c.Name())
+	for index, message := range messages {
+		if errs[index] == nil {
+			c.notifyEvent(QueueEventComplete, message)
+		}
+	}
+
+	if failed > 0 {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// AbandonBatch method are returns multiple messages into the queue in one operation.
+// Messages that fail to abandon do not prevent other messages from being returned.
+//   - messages  a list of messages to return.
+// Returns: *BatchError with errors of failed messages or nil for success.
+// See Abandon
+func (c *MemoryMessageQueue) AbandonBatch(messages []*MessageEnvelope) (err error) {
+	errs := make([]error, len(messages))
+	events := make([]QueueEvent, len(messages))
+	failed := 0
+	dead := 0
+
+	c.Lock.Lock()
+	for index, message := range messages {
+		var moved bool
+		moved, errs[index] = c.abandonMessage(message, 0)
+		if errs[index] != nil {
+			failed++
+		} else if moved {
+			dead++
+			events[index] = QueueEventDeadLetter
+		} else {
+			events[index] = QueueEventAbandon
+		}
+	}
+	c.Lock.Unlock()
+
+	if dead > 0 {
+		c.Counters.Increment(c.counterKeys.dead, dead)
+	}
+	c.Logger.Trace("", "Abandoned %d messages at %s", len(messages)-failed, c.Name())
+	for index, message := range messages {
+		if errs[index] == nil {
+			c.notifyEvent(events[index], message)
+		}
+	}
+
+	if failed > 0 {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// MoveToDeadLetter method are permanently removes a message from the queue and sends it to dead letter queue.
+//   - message   a message to be removed.
+// Returns: error or nil for success.
+// See MoveToDeadLetterWithReason
+func (c *MemoryMessageQueue) MoveToDeadLetter(message *MessageEnvelope) (err error) {
+	return c.MoveToDeadLetterWithReason(message, "")
+}
+
+// MoveToDeadLetterWithReason method are permanently removes a message from the queue and sends it
+// to dead letter queue. The reason is stored in the DeadLetterReasonHeader header of the dead message.
+//   - message   a message to be removed.
+//   - reason    (optional) a reason why the message could not be processed.
+// Returns: error or nil for success.
+func (c *MemoryMessageQueue) MoveToDeadLetterWithReason(message *MessageEnvelope, reason string) (err error) {
+	c.Lock.Lock()
+	lockedToken, lockedMessage, err := c.findLockedMessage(message)
+	if err != nil {
+		if errors.Is(err, ErrLockExpired) {
+			c.requeueExpiredLock(lockedToken, lockedMessage, message)
+		}
+		c.Lock.Unlock()
+		return err
+	}
+
+	c.unlockMessage(lockedToken)
+	message.SetReference(nil)
+	lockedMessage.Message.SetReference(nil)
+	c.pushDeadLetter(lockedMessage.Message, reason)
+	c.Lock.Unlock()
+
+	c.Counters.IncrementOne(c.counterKeys.dead)
+	c.Logger.Trace(message.CorrelationId, "Moved to dead message %s at %s", message, c.Name())
+	c.notifyEvent(QueueEventDeadLetter, message)
+
+	return nil
+}
+
+// SweepExpiredLocks method are immediately returns all received messages with expired locks back to the queue.
+// It does the same work as the background lock reaper, but on demand.
+// Returns: number of returned messages or error.
+func (c *MemoryMessageQueue) SweepExpiredLocks() (int, error) {
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return 0, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	released := c.releaseExpiredLocks()
+	c.Lock.Unlock()
+
+	if released > 0 {
+		c.Logger.Debug("", "Swept %d expired locks at %s", released, c.Name())
+	}
+
+	return released, nil
+}
+
+// ReadDeadLetterCount method are reads the current number of messages in the dead letter queue.
+// Returns: number of messages or error.
+func (c *MemoryMessageQueue) ReadDeadLetterCount() (count int64, err error) {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	count = (int64)(len(c.deadLetters))
+	return count, nil
+}
+
+// PeekDeadLetter method are peeks all messages from the dead letter queue without removing them.
+// Returned messages are copies that can be changed without affecting the queue.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: a list with messages or error.
+func (c *MemoryMessageQueue) PeekDeadLetter(correlationId string) (result []MessageEnvelope, err error) {
+	c.Lock.RLock()
+	result = make([]MessageEnvelope, len(c.deadLetters))
+	for index := range c.deadLetters {
+		result[index] = *c.deadLetters[index].Clone()
+	}
+	c.Lock.RUnlock()
+
+	for index := range result {
+		message, err := c.decryptMessage(&result[index])
+		if err != nil {
+			return nil, err
+		}
+		result[index] = *message
+	}
+
+	c.Logger.Trace(correlationId, "Peeked %d dead messages on %s", len(result), c.Name())
+
+	return result, nil
+}
+
+// RequeueFromDeadLetter method are moves a message from the dead letter queue back to the queue.
+// The message gets a reset delivery count and loses its dead letter reason header.
+// It is checked against the queue capacity the same way as a sent message.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - messageId         an id of the message to be moved.
+// Returns: error or nil for success.
+func (c *MemoryMessageQueue) RequeueFromDeadLetter(correlationId string, messageId string) (err error) {
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	if c.deadLetterIndex(messageId) < 0 {
+		c.Lock.Unlock()
+		return ErrMessageNotFound
+	}
+
+	err = c.waitForSpace(0)
+	if err != nil {
+		c.Lock.Unlock()
+		return err
+	}
+
+	// The lock is released while waiting for space,
+	// so the message could be requeued by another thread
+	index := c.deadLetterIndex(messageId)
+	if index < 0 {
+		c.Lock.Unlock()
+		return ErrMessageNotFound
+	}
+
+	message := c.deadLetters[index]
+	c.deadLetters = append(c.deadLetters[:index], c.deadLetters[index+1:]...)
+	c.restoreDeadLetter(message)
+	c.Lock.Unlock()
+
+	c.Logger.Trace(correlationId, "Requeued dead message %s at %s", message.String(), c.Name())
+
+	return nil
+}
+
+// RequeueAllFromDeadLetter method are moves all messages from dead letter queue back to the queue.
+// Messages get a reset delivery count and lose their dead letter reason header.
+// They are checked against the queue capacity the same way as sent messages,
+// and messages that do not fit into the queue are left in dead letter queue.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: number of requeued messages or error.
+func (c *MemoryMessageQueue) RequeueAllFromDeadLetter(correlationId string) (count int, err error) {
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return 0, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+
+	for len(c.deadLetters) > 0 {
+		err = c.waitForSpace(0)
+		if err != nil || len(c.deadLetters) == 0 {
+			break
+		}
+
+		message := c.deadLetters[0]
+		c.deadLetters = c.deadLetters[1:]
+		c.restoreDeadLetter(message)
+		count++
+	}
+	c.Lock.Unlock()
+
+	c.Logger.Trace(correlationId, "Requeued %d dead messages at %s", count, c.Name())
+
+	return count, err
+}
+
+// Rewind method are returns retained completed messages back to the queue to be received again.
+// Messages are retained only when retain.max_count is configured. Capacity is respected
+// the same way as for sent messages, and messages that do not fit stay retained.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: error or nil for success.
+func (c *MemoryMessageQueue) Rewind(correlationId string) (err error) {
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+
+	count := 0
+	for len(c.retained) > 0 {
+		err = c.waitForSpace(0)
+		if err != nil || len(c.retained) == 0 {
+			break
+		}
+
+		message := c.retained[0]
+		c.retained = c.retained[1:]
+		c.pushMessage(message)
+		c.messageAvailable.Broadcast()
+		count++
+	}
+	c.Lock.Unlock()
+
+	c.Logger.Trace(correlationId, "Rewound %d completed messages at %s", count, c.Name())
+
+	return err
+}
+
+// memoryMessageQueueState is a serializable snapshot of the queue content.
+type memoryMessageQueueState struct {
+	Messages       []*MessageEnvelope `json:"messages"`
+	LockedMessages []*MessageEnvelope `json:"locked_messages"`
+	DeadLetters    []*MessageEnvelope `json:"dead_letters"`
+}
+
+// SaveToFile method are saves pending, locked and dead messages into a JSON file.
+// Message delays are not preserved, so delayed messages become visible after they are loaded.
+//   - path              a path to the file.
+// Returns: error or nil for success.
+// See LoadFromFile
+func (c *MemoryMessageQueue) SaveToFile(path string) (err error) {
+	c.Lock.RLock()
+	state := memoryMessageQueueState{
+		Messages:       make([]*MessageEnvelope, 0, len(c.messages)),
+		LockedMessages: make([]*MessageEnvelope, 0, len(c.lockedMessages)),
+		DeadLetters:    make([]*MessageEnvelope, 0, len(c.deadLetters)),
+	}
+	for index := range c.messages {
+		state.Messages = append(state.Messages, c.messages[index].Clone())
+	}
+	tokens := make([]int, 0, len(c.lockedMessages))
+	for token := range c.lockedMessages {
+		tokens = append(tokens, token)
+	}
+	sort.Ints(tokens)
+	for _, token := range tokens {
+		state.LockedMessages = append(state.LockedMessages, c.lockedMessages[token].Message.Clone())
+	}
+	for index := range c.deadLetters {
+		state.DeadLetters = append(state.DeadLetters, c.deadLetters[index].Clone())
+	}
+	c.Lock.RUnlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// LoadFromFile method are replaces the queue content with messages saved by SaveToFile.
+// Locked messages are returned back to the queue since their receivers are gone.
+// Retained messages and remembered message ids are dropped together with the old content.
+//   - path              a path to the file.
+// Returns: error or nil for success. ErrQueueClosed is returned if the queue is not opened.
+// See SaveToFile
+func (c *MemoryMessageQueue) LoadFromFile(path string) (err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var state memoryMessageQueueState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	if !c.opened {
+		return fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+
+	c.messages = make([]MessageEnvelope, 0, len(state.Messages)+len(state.LockedMessages))
+	c.lockedMessages = make(map[int]*LockedMessage, 0)
+	c.lockedGroups = make(map[string]int)
+	c.deadLetters = make([]MessageEnvelope, 0, len(state.DeadLetters))
+	c.retained = make([]MessageEnvelope, 0)
+	c.seenMessageIds = make(map[string]time.Time)
+	c.hasExpiring = false
+
+	for _, message := range state.LockedMessages {
+		c.pushMessageLast(*message)
+	}
+	for _, message := range state.Messages {
+		c.pushMessageLast(*message)
+	}
+	for _, message := range state.DeadLetters {
+		c.deadLetters = append(c.deadLetters, *message)
+	}
+
+	c.messageAvailable.Broadcast()
+	c.spaceAvailable.Broadcast()
+	c.lockReleased.Broadcast()
+
+	return nil
+}
+
+// ImportJSONL method are reads messages from a JSON Lines file with one message envelope per line
+// and sends them into the queue. Empty lines are skipped. Imported messages are treated as new
+// messages, so their delivery counts are reset to zero.
+//   - path              a path to the file.
+// Returns: number of sent messages or error. Malformed lines are reported
+// with ErrInvalidMessageEnvelope and their line number, and then no messages are sent.
+// See ExportJSONL
+func (c *MemoryMessageQueue) ImportJSONL(path string) (count int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	envelopes := make([]*MessageEnvelope, 0)
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return 0, readErr
+		}
+
+		data = bytes.TrimSpace(data)
+		if len(data) > 0 {
+			envelope := NewEmptyMessageEnvelope()
+			err = json.Unmarshal(data, envelope)
+			if err != nil {
+				return 0, fmt.Errorf("%w: line %d: %v", ErrInvalidMessageEnvelope, line, err)
+			}
+			envelope.DeliveryCount = 0
+			envelopes = append(envelopes, envelope)
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	for _, envelope := range envelopes {
+		err = c.Send(envelope.CorrelationId, envelope)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// ExportJSONL method are writes pending messages into a JSON Lines file with one message envelope per line
+// in the order they would be received. Locked and dead messages are not exported.
+//   - path              a path to the file.
+// Returns: number of written messages or error.
+// See ImportJSONL
+func (c *MemoryMessageQueue) ExportJSONL(path string) (count int, err error) {
+	c.Lock.RLock()
+	messages := make([]*MessageEnvelope, 0, len(c.messages))
+	for index := range c.messages {
+		messages = append(messages, c.messages[index].Clone())
+	}
+	c.Lock.RUnlock()
+
+	var buffer bytes.Buffer
+	for _, message := range messages {
+		message, err = c.decryptMessage(message)
+		if err != nil {
+			return 0, err
+		}
+
+		data, err := json.Marshal(message)
+		if err != nil {
+			return 0, err
+		}
+		buffer.Write(data)
+		buffer.WriteByte('\n')
+	}
+
+	err = os.WriteFile(path, buffer.Bytes(), 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(messages), nil
+}
+
+// Listen method are listens for incoming messages and blocks the current thread until queue is closed.
+// Only one listener can be active at a time, use ListenWithWorkers for concurrent processing.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - receiver          a receiver to receive incoming messages.
+// Returns: ErrAlreadyListening if the queue is already listened, or nil when listening ends.
+// See IMessageReceiver
+// See Receive
+func (c *MemoryMessageQueue) Listen(correlationId string, receiver IMessageReceiver) error {
+	return c.ListenWithWorkers(correlationId, receiver, 1)
+}
+
+// GetListenInterval method are gets the time a listener currently waits for a message in one receive call.
+// The interval adapts to the load between receive.min_poll_interval and receive.max_poll_interval.
+// Returns: the current listen interval or 0 if the queue was never listened.
+func (c *MemoryMessageQueue) GetListenInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.listenInterval))
+}
+
+// BlockingListen method are listens for incoming messages on the current thread
+// and returns only after EndListen or Close is called.
+// It is the same as Listen and makes the blocking behavior explicit in the calling code.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - receiver          a receiver to receive incoming messages.
+// See Listen
+// See EndListen
+func (c *MemoryMessageQueue) BlockingListen(correlationId string, receiver IMessageReceiver) error {
+	return c.Listen(correlationId, receiver)
+}
+
+// ListenWithWorkers method are listens for incoming messages using multiple concurrent workers
+// and blocks the current thread until queue is closed.
+// Each worker receives messages one by one and passes them to the receiver.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - receiver          a receiver to receive incoming messages.
+//   - workers           a number of concurrent workers.
+// See IMessageReceiver
+// See Listen
+func (c *MemoryMessageQueue) ListenWithWorkers(correlationId string, receiver IMessageReceiver, workers int) error {
+	return c.listen(correlationId, receiver, workers, nil)
+}
+
+// ListenWithFilter method are listens for incoming messages that match the predicate
+// and blocks the current thread until queue is closed.
+// Messages that do not match the predicate are left in the queue for other consumers.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - receiver          a receiver to receive incoming messages.
+//   - predicate         a function that returns true for messages to be received.
+// See IMessageReceiver
+// See Listen
+func (c *MemoryMessageQueue) ListenWithFilter(correlationId string, receiver IMessageReceiver,
+	predicate func(*MessageEnvelope) bool) error {
+	return c.listen(correlationId, receiver, 1, predicate)
+}
+
+// Messages method are returns a channel that delivers incoming messages received in a background thread.
+// Messages on the channel are locked and shall be completed or abandoned by the consumer.
+// The returned cancel function stops delivery, returns a message that could not be delivered
+// back to the queue and closes the channel.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: a channel with incoming messages and a function to cancel delivery.
+func (c *MemoryMessageQueue) Messages(correlationId string) (<-chan *MessageEnvelope, func()) {
+	messages := make(chan *MessageEnvelope)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	// Wait for messages in short intervals to notice cancellation quickly
+	waitTimeout := c.minPollInterval
+	if waitTimeout <= 0 {
+		waitTimeout = c.pollInterval
+	}
+
+	go func() {
+		defer close(done)
+		defer close(messages)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			message, err := c.receiveMatching(correlationId, waitTimeout, c.lockTimeout, nil, nil)
+			if errors.Is(err, ErrQueueClosed) {
+				// Wait until the queue is opened
+				select {
+				case <-stop:
+					return
+				case <-time.After(c.pollInterval):
+				}
+				continue
+			}
+			if err != nil {
+				c.Logger.Error(correlationId, err, "Failed to receive the message")
+			}
+			if message == nil {
+				continue
+			}
+
+			select {
+			case messages <- message:
+			case <-stop:
+				c.Abandon(message)
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(stop)
+		})
+		<-done
+	}
+
+	return messages, cancel
+}
+
+// ReceiveChan method are returns a channel that delivers incoming messages until the context is done.
+// It allows to receive messages from multiple queues in one select statement.
+// Messages on the channel are locked and shall be completed or abandoned by the consumer.
+// When the context is done, a message that could not be delivered is returned back to the queue
+// and the channel is closed.
+//   - ctx     a context to stop delivery.
+// Returns: a channel with incoming messages.
+// See Messages
+func (c *MemoryMessageQueue) ReceiveChan(ctx context.Context) <-chan *MessageEnvelope {
+	messages, cancel := c.Messages("")
+
+	go func() {
+		<-ctx.Done()
+		cancel()
+	}()
+
+	return messages
+}
+
+// listen starts listening workers and blocks until listening is cancelled.
+func (c *MemoryMessageQueue) listen(correlationId string, receiver IMessageReceiver, workers int,
+	predicate func(*MessageEnvelope) bool) error {
+	// Filtered listeners may share the queue, but unfiltered ones would compete for all messages
+	c.Lock.Lock()
+	if predicate == nil && c.listening {
+		c.Lock.Unlock()
+		return fmt.Errorf("%w: queue %s", ErrAlreadyListening, c.Name())
+	}
+	if predicate == nil {
+		c.listening = true
+	}
+	c.listeners++
+	c.Lock.Unlock()
+
+	c.Logger.Trace("", "Started listening messages at %s", c.String())
+
+	// Unset cancellation token
+	atomic.StoreInt32(&c.cancel, 0)
+
+	defer func() {
+		c.Lock.Lock()
+		if predicate == nil {
+			c.listening = false
+		}
+		c.listeners--
+		c.listenStopped.Broadcast()
+		c.Lock.Unlock()
+	}()
+
+	// Start additional workers, the last one runs in the current thread
+	var wg sync.WaitGroup
+	for worker := 1; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.listenLoop(correlationId, receiver, predicate)
+		}()
+	}
+
+	c.listenLoop(correlationId, receiver, predicate)
+	wg.Wait()
+
+	return nil
+}
+
+// EndListen method are ends listening for incoming messages.
+// When c method is call listen unblocks the thread and execution continues.
+// The method returns after all listening loops are stopped,
+// so it shall not be called from inside of a message receiver.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+func (c *MemoryMessageQueue) EndListen(correlationId string) {
+	atomic.StoreInt32(&c.cancel, 1)
+
+	c.Lock.Lock()
+	for c.listeners > 0 {
+		c.listenStopped.Wait()
+	}
+	c.Lock.Unlock()
+}
+
+// listenLoop receives messages and passes them to the receiver until listening is cancelled.
+// The time to wait for a message in one receive call adapts to the load.
+func (c *MemoryMessageQueue) listenLoop(correlationId string, receiver IMessageReceiver,
+	predicate func(*MessageEnvelope) bool) {
+	interval := c.nextPollInterval(0, true)
+	receive := func() (*MessageEnvelope, error) {
+		message, err := c.receiveMatching(correlationId, interval, c.lockTimeout, predicate, nil)
+		interval = c.nextPollInterval(interval, message != nil)
+		atomic.StoreInt64(&c.listenInterval, int64(interval))
+		return message, err
+	}
+
+	c.receiveLoop(correlationId, receiver, receive, &c.cancel, c.pollInterval, c.autoAck)
+}
+
+// nextPollInterval calculates how long a listener waits for the next message.
+// The interval is reset to the minimum while messages are flowing and doubles
+// up to the maximum while the queue stays empty.
+func (c *MemoryMessageQueue) nextPollInterval(interval time.Duration, received bool) time.Duration {
+	maxInterval := c.maxPollInterval
+	if maxInterval <= 0 {
+		maxInterval = c.pollInterval
+	}
+	minInterval := c.minPollInterval
+	if minInterval <= 0 || minInterval > maxInterval {
+		minInterval = maxInterval
+	}
+
+	if received {
+		return minInterval
+	}
+
+	interval *= 2
+	if interval < minInterval {
+		interval = minInterval
+	}
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+	return interval
+}
+
+// pushMessage inserts a new message into the queue ordered by priority.
+// Messages with higher priority go first, messages with the same priority
+// follow the configured delivery order.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) pushMessage(message MessageEnvelope) {
+	if c.lifo {
+		c.pushMessageFirst(message)
+	} else {
+		c.pushMessageLast(message)
+	}
+}
+
+// pushMessageLast inserts a message into the queue behind other messages with the same priority.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) pushMessageLast(message MessageEnvelope) {
+	index := len(c.messages)
+	for index > 0 && c.messages[index-1].Priority < message.Priority {
+		index--
+	}
+
+	c.insertMessage(index, message)
+}
+
+// pushMessageFirst inserts a message into the queue ahead of other messages with the same priority.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) pushMessageFirst(message MessageEnvelope) {
+	index := 0
+	for index < len(c.messages) && c.messages[index].Priority > message.Priority {
+		index++
+	}
+
+	c.insertMessage(index, message)
+}
+
+// requeueMessage returns a previously received message back into the queue.
+// A message from a group is placed ahead of the pending messages of the same group,
+// so the group keeps its original delivery order.
+//   - message   a message to be returned.
+//   - first     true to place the message ahead of other messages with the same priority.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) requeueMessage(message MessageEnvelope, first bool) {
+	index := 0
+	if first {
+		for index < len(c.messages) && c.messages[index].Priority > message.Priority {
+			index++
+		}
+	} else {
+		index = len(c.messages)
+		for index > 0 && c.messages[index-1].Priority < message.Priority {
+			index--
+		}
+	}
+
+	// Keep the message at the head of its group among messages with the same priority
+	if message.GroupId != "" && c.lifo {
+		for i := index; i < len(c.messages); i++ {
+			if c.messages[i].GroupId == message.GroupId && c.messages[i].Priority == message.Priority {
+				index = i + 1
+			}
+		}
+	} else if message.GroupId != "" {
+		for i := 0; i < index; i++ {
+			if c.messages[i].GroupId == message.GroupId && c.messages[i].Priority == message.Priority {
+				index = i
+				break
+			}
+		}
+	}
+
+	c.insertMessage(index, message)
+}
+
+// requeueExpiredLock removes an expired lock and returns the message back into the queue.
+// Must be called under the lock.
+//   - lockedToken     a token of the expired lock.
+//   - lockedMessage   the expired locked message.
+//   - message         an envelope handed to the consumer.
+func (c *MemoryMessageQueue) requeueExpiredLock(lockedToken int, lockedMessage *LockedMessage, message *MessageEnvelope) {
+	requeued := *lockedMessage.Message
+	requeued.SetReference(nil)
+
+	c.unlockMessage(lockedToken)
+	if message != nil {
+		message.SetReference(nil)
+	}
+
+	c.requeueMessage(requeued, false)
+	c.messageAvailable.Broadcast()
+}
+
+// insertMessage inserts a message into the queue at the given position.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) insertMessage(index int, message MessageEnvelope) {
+	c.messages = append(c.messages, MessageEnvelope{})
+	copy(c.messages[index+1:], c.messages[index:])
+	c.messages[index] = message
+
+	if !message.ExpiresAt.IsZero() {
+		c.hasExpiring = true
+	}
+}
+
+// recordLatency records time in milliseconds the message spent in the queue.
+// Messages without sent time are skipped.
+func (c *MemoryMessageQueue) recordLatency(message *MessageEnvelope) {
+	if message.SentTime.IsZero() {
+		return
+	}
+
+	latency := c.clock().Sub(message.SentTime)
+	c.Counters.Stats(c.counterKeys.latency, float32(latency)/float32(time.Millisecond))
+}
+
+// lockMessage removes the message from the queue and locks it for the receiver.
+// Must be called under the lock.
+// Returns: the received message with the lock token set as its reference.
+func (c *MemoryMessageQueue) lockMessage(index int, lockTimeout time.Duration) *MessageEnvelope {
+	// Get message from the queue
+	received := c.removeMessage(index)
+	lockedMessage := &LockedMessage{
+		Message: &received,
+	}
+
+	return c.addLockedMessage(lockedMessage, lockTimeout)
+}
+
+// lockMessageInto removes the message from the queue, locks it for the receiver
+// and copies it into the provided envelope. The locked message is kept in a record
+// that is reused after the lock is released, so no new envelopes are allocated.
+// Must be called under the lock.
+// Returns: the provided envelope with the lock token set as its reference.
+func (c *MemoryMessageQueue) lockMessageInto(index int, lockTimeout time.Duration, dst *MessageEnvelope) *MessageEnvelope {
+	var lockedMessage *LockedMessage
+	if count := len(c.freeLocks); count > 0 {
+		lockedMessage = c.freeLocks[count-1]
+		c.freeLocks[count-1] = nil
+		c.freeLocks = c.freeLocks[:count-1]
+	} else {
+		lockedMessage = &LockedMessage{
+			Message: &MessageEnvelope{},
+			reused:  true,
+		}
+	}
+	*lockedMessage.Message = c.removeMessage(index)
+
+	*dst = *c.addLockedMessage(lockedMessage, lockTimeout)
+	return dst
+}
+
+// addLockedMessage generates a lock token for the removed message and adds it to locked messages.
+// Messages received without waiting are locked for the configured receive lock timeout.
+// Must be called under the lock.
+// Returns: the locked message with the lock token set as its reference.
+func (c *MemoryMessageQueue) addLockedMessage(lockedMessage *LockedMessage, lockTimeout time.Duration) *MessageEnvelope {
+	if lockTimeout <= 0 {
+		lockTimeout = c.lockTimeout
+	}
+
+	message := lockedMessage.Message
+	message.DeliveryCount++
+	c.receivedCount++
+
+	// Generate and set locked token
+	lockedToken := c.lockTokenSequence
+	c.lockTokenSequence++
+	message.SetReference(lockedToken)
+
+	// Add messages to locked messages list
+	lockedMessage.ExpirationTime = c.clock().Add(lockTimeout)
+	lockedMessage.Timeout = lockTimeout
+	c.lockedMessages[lockedToken] = lockedMessage
+	if message.GroupId != "" {
+		c.lockedGroups[message.GroupId]++
+	}
+
+	return message
+}
+
+// completeMessage removes the message lock. Must be called under the lock.
+func (c *MemoryMessageQueue) completeMessage(message *MessageEnvelope) error {
+	lockedToken, lockedMessage, err := c.findLockedMessage(message)
+	if err != nil {
+		if errors.Is(err, ErrLockExpired) {
+			c.requeueExpiredLock(lockedToken, lockedMessage, message)
+		}
+		return err
+	}
+
+	c.unlockMessage(lockedToken)
+	message.SetReference(nil)
+
+	if c.retainMaxCount > 0 {
+		lockedMessage.Message.SetReference(nil)
+		c.retained = append(c.retained, *lockedMessage.Message)
+		if len(c.retained) > c.retainMaxCount {
+			c.retained = c.retained[len(c.retained)-c.retainMaxCount:]
+		}
+	}
+	return nil
+}
+
+// abandonMessage removes the message lock and returns the message back into the queue
+// to become visible after the delay, or moves it to dead letter queue
+// when it reached the maximum delivery count.
+// Must be called under the lock.
+// Returns: true if the message was moved to dead letter queue, or error.
+func (c *MemoryMessageQueue) abandonMessage(message *MessageEnvelope, delay time.Duration) (bool, error) {
+	// Get message from locked queue
+	lockedToken, lockedMessage, err := c.findLockedMessage(message)
+	if err != nil {
+		if errors.Is(err, ErrLockExpired) {
+			c.requeueExpiredLock(lockedToken, lockedMessage, message)
+		}
+		return false, err
+	}
+
+	// Remove from locked messages
+	c.unlockMessage(lockedToken)
+	message.SetReference(nil)
+	lockedMessage.Message.SetReference(nil)
+
+	// Move poison messages to dead letter queue
+	if c.maxDeliveryCount > 0 && lockedMessage.Message.DeliveryCount >= c.maxDeliveryCount {
+		c.pushDeadLetter(lockedMessage.Message, "maximum delivery count exceeded")
+		return true, nil
+	}
+
+	// Add back to message queue.
+	// Returned messages were already accepted, so they bypass the capacity check.
+	requeued := *lockedMessage.Message
+	if delay > 0 {
+		requeued.visibleTime = c.clock().Add(delay)
+	}
+	c.requeueMessage(requeued, c.preserveOrder)
+	c.messageAvailable.Broadcast()
+	return false, nil
+}
+
+// stampMessage generates a message id, sets the default message type and generates a correlation id
+// for a message being sent when they are not set.
+func (c *MemoryMessageQueue) stampMessage(message *MessageEnvelope) {
+	if message.MessageId == "" {
+		message.MessageId = c.idGenerator()
+	}
+	if message.MessageType == "" {
+		message.MessageType = c.defaultType
+	}
+	if message.CorrelationId == "" && c.generateCorrId {
+		message.CorrelationId = cdata.IdGenerator.NextLong()
+	}
+}
+
+// checkMessage checks that the message is valid when validation is enabled
+// and that the message payload does not exceed the configured limit.
+func (c *MemoryMessageQueue) checkMessage(message *MessageEnvelope) error {
+	if c.validateOnSend {
+		if errs := message.Validate(); len(errs) > 0 {
+			return errs[0]
+		}
+	}
+	if c.maxMessageSize > 0 && len(message.Message) > c.maxMessageSize {
+		return fmt.Errorf("%w: message %s has %d bytes, allowed %d bytes",
+			ErrMessageTooLarge, message.MessageId, len(message.Message), c.maxMessageSize)
+	}
+	if c.validator != nil {
+		if err := c.validator.ValidateMessage(message); err != nil {
+			c.rejectMessage(message, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// rejectMessage moves a message that failed validation to dead letter queue when configured.
+// The original envelope is not changed.
+func (c *MemoryMessageQueue) rejectMessage(message *MessageEnvelope, reason error) {
+	c.Logger.Debug(message.CorrelationId, "Rejected invalid message %s at %s: %s",
+		message.String(), c.Name(), reason.Error())
+
+	if !c.deadLetterInvalid {
+		return
+	}
+
+	dead := *message
+	dead.SentTime = c.clock()
+	if c.encryptMessage(&dead) != nil {
+		return
+	}
+
+	c.Lock.Lock()
+	if !c.opened {
+		c.Lock.Unlock()
+		return
+	}
+	c.pushDeadLetter(&dead, "validation failed: "+reason.Error())
+	c.Lock.Unlock()
+
+	c.Counters.IncrementOne(c.counterKeys.dead)
+	c.notifyEvent(QueueEventDeadLetter, message)
+}
+
+// encryptMessage encrypts the message payload when the queue has a cipher.
+// Headers are copied, so the original envelope is not changed.
+func (c *MemoryMessageQueue) encryptMessage(message *MessageEnvelope) error {
+	if c.cipher == nil {
+		return nil
+	}
+	if _, ok := message.GetHeader(encryptionHeader); ok {
+		return nil
+	}
+
+	data, err := c.cipher.Encrypt(message.Message)
+	if err != nil {
+		return err
+	}
+
+	headers := make(map[string]string, len(message.Headers)+1)
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+	headers[encryptionHeader] = "cipher"
+
+	message.Headers = headers
+	message.Message = data
+	return nil
+}
+
+// decryptMessage returns a copy of the message with decrypted payload.
+// Messages that were not encrypted are returned as is.
+func (c *MemoryMessageQueue) decryptMessage(message *MessageEnvelope) (*MessageEnvelope, error) {
+	if _, ok := message.GetHeader(encryptionHeader); !ok || c.cipher == nil {
+		return message, nil
+	}
+
+	data, err := c.cipher.Decrypt(message.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	result := message.Clone()
+	result.SetReference(message.GetReference())
+	result.RemoveHeader(encryptionHeader)
+	result.Message = data
+	return result, nil
+}
+
+// leftoverMessages returns copies of messages to be delivered followed by locked messages
+// in the order they were received. Must be called under the lock.
+func (c *MemoryMessageQueue) leftoverMessages() []*MessageEnvelope {
+	messages := make([]*MessageEnvelope, 0, len(c.messages)+len(c.lockedMessages))
+	for index := range c.messages {
+		messages = append(messages, c.messages[index].Clone())
+	}
+	tokens := make([]int, 0, len(c.lockedMessages))
+	for token := range c.lockedMessages {
+		tokens = append(tokens, token)
+	}
+	sort.Ints(tokens)
+	for _, token := range tokens {
+		messages = append(messages, c.lockedMessages[token].Message.Clone())
+	}
+	return messages
+}
+
+// decryptMessages decrypts the messages in place.
+// Messages that fail to decrypt are kept encrypted.
+func (c *MemoryMessageQueue) decryptMessages(messages []*MessageEnvelope) []*MessageEnvelope {
+	for index, message := range messages {
+		decrypted, err := c.decryptMessage(message)
+		if err != nil {
+			c.Logger.Error(message.CorrelationId, err, "Failed to decrypt message %s", message)
+			continue
+		}
+		messages[index] = decrypted
+	}
+	return messages
+}
+
+// findLockedMessage finds a locked message referenced by the given envelope.
+// The queue is not modified, the caller decides what to do with an expired lock.
+// Must be called under the lock.
+// Returns: lock token and the locked message, or ErrQueueClosed, ErrMessageNotReceived,
+// ErrMessageNotLocked error. When the lock has expired the token and the message
+// are returned together with ErrLockExpired error.
+func (c *MemoryMessageQueue) findLockedMessage(message *MessageEnvelope) (int, *LockedMessage, error) {
+	if !c.opened {
+		return 0, nil, fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	if message == nil || message.GetReference() == nil {
+		return 0, nil, ErrMessageNotReceived
+	}
+
+	lockedToken, ok := message.GetReference().(int)
+	if !ok {
+		return 0, nil, ErrMessageNotLocked
+	}
+
+	lockedMessage, ok := c.lockedMessages[lockedToken]
+	if !ok {
+		return 0, nil, ErrMessageNotLocked
+	}
+
+	if !lockedMessage.ExpirationTime.After(c.clock()) {
+		return lockedToken, lockedMessage, fmt.Errorf("%w: message %s", ErrLockExpired, message.MessageId)
+	}
+
+	return lockedToken, lockedMessage, nil
+}
+
+// unlockMessage removes a message lock and notifies processes waiting for locks to be released.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) unlockMessage(lockedToken int) {
+	lockedMessage, ok := c.lockedMessages[lockedToken]
+	if ok && lockedMessage.Message.GroupId != "" {
+		groupId := lockedMessage.Message.GroupId
+		c.lockedGroups[groupId]--
+		if c.lockedGroups[groupId] <= 0 {
+			delete(c.lockedGroups, groupId)
+			// Next message of the group can be received now
+			c.messageAvailable.Broadcast()
+		}
+	}
+
+	// Records of messages copied to receivers are reused by the next receive.
+	// The record stays valid until the lock is released by the caller.
+	if ok && lockedMessage.reused && len(c.freeLocks) < maxFreeLocks {
+		c.freeLocks = append(c.freeLocks, lockedMessage)
+	}
+
+	delete(c.lockedMessages, lockedToken)
+	c.lockReleased.Broadcast()
+}
+
+// nextReceivableIndex finds the first message in the queue that can be received:
+// it is visible, matches the predicate and, when it belongs to a group,
+// it is the head of the group and the group has no other received messages.
+// Must be called under the lock.
+// Returns: index of the message or -1 if no messages are available.
+func (c *MemoryMessageQueue) nextReceivableIndex(now time.Time, predicate func(*MessageEnvelope) bool) int {
+	heads := c.groupHeads()
+	if heads == nil {
+		return c.nextMessageIndex(now, predicate)
+	}
+
+	return c.nextMessageIndex(now, func(message *MessageEnvelope) bool {
+		if message.GroupId != "" {
+			if c.lockedGroups[message.GroupId] > 0 || &c.messages[heads[message.GroupId]] != message {
+				return false
+			}
+		}
+		return predicate == nil || predicate(message)
+	})
+}
+
+// groupHeads finds messages to be delivered next in each group.
+// Messages with higher priority go first, and messages with the same priority
+// go in the order they were sent: first in fifo queue and last in lifo queue.
+// Must be called under the lock.
+// Returns: indexes of group heads by group id or nil if there are no grouped messages.
+func (c *MemoryMessageQueue) groupHeads() map[string]int {
+	var heads map[string]int
+	for index := range c.messages {
+		groupId := c.messages[index].GroupId
+		if groupId == "" {
+			continue
+		}
+		if heads == nil {
+			heads = make(map[string]int)
+		}
+		head, ok := heads[groupId]
+		if !ok || (c.lifo && c.messages[head].Priority == c.messages[index].Priority) {
+			heads[groupId] = index
+		}
+	}
+	return heads
+}
+
+// nextMessageIndex finds the first message in the queue that is visible to receivers
+// and matches the predicate. Nil predicate matches all messages.
+// Must be called under the lock.
+// Returns: index of the message or -1 if no messages are available.
+func (c *MemoryMessageQueue) nextMessageIndex(now time.Time, predicate func(*MessageEnvelope) bool) int {
+	for index := range c.messages {
+		if !c.isMessageVisible(&c.messages[index], now) {
+			continue
+		}
+		if predicate != nil && !predicate(&c.messages[index]) {
+			continue
+		}
+		return index
+	}
+	return -1
+}
+
+// isClosed checks if the queue was closed and waiting receivers shall return.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) isClosed() bool {
+	return !c.opened && atomic.LoadInt32(&c.cancel) != 0
+}
+
+// isMessageVisible checks if a queued message can be delivered to receivers:
+// it is not delayed and not expired.
+func (c *MemoryMessageQueue) isMessageVisible(message *MessageEnvelope, now time.Time) bool {
+	if message.visibleTime.After(now) {
+		return false
+	}
+	if !message.ExpiresAt.IsZero() && !message.ExpiresAt.After(now) {
+		return false
+	}
+	return true
+}
+
+// pushDeadLetter adds a copy of the message to dead letter queue
+// and stores the reason in its headers. Must be called under the lock.
+func (c *MemoryMessageQueue) pushDeadLetter(message *MessageEnvelope, reason string) {
+	dead := message.Clone()
+	if reason != "" {
+		dead.SetHeader(DeadLetterReasonHeader, reason)
+	}
+	c.deadLetters = append(c.deadLetters, *dead)
+	c.deadCount++
+}
+
+// deadLetterIndex finds a message with the given id in dead letter queue.
+// Must be called under the lock.
+// Returns: index of the message or -1 if it was not found.
+func (c *MemoryMessageQueue) deadLetterIndex(messageId string) int {
+	for i := range c.deadLetters {
+		if c.deadLetters[i].MessageId == messageId {
+			return i
+		}
+	}
+	return -1
+}
+
+// restoreDeadLetter resets the delivery count and the dead letter reason of a dead message
+// and returns it back to the queue. Must be called under the lock.
+func (c *MemoryMessageQueue) restoreDeadLetter(dead MessageEnvelope) {
+	// Headers may be shared with copies handed out before
+	message := dead.Clone()
+	message.DeliveryCount = 0
+	message.RemoveHeader(DeadLetterReasonHeader)
+	c.pushMessage(*message)
+	c.messageAvailable.Broadcast()
+}
+
+// discardExpiredMessages removes expired messages from the queue
+// or moves them to dead letter queue when configured. Must be called under the lock.
+// Returns: number of expired messages.
+func (c *MemoryMessageQueue) discardExpiredMessages() int {
+	if !c.hasExpiring {
+		return 0
+	}
+
+	now := c.clock()
+	messages := c.messages[:0]
+	expired := 0
+	for _, message := range c.messages {
+		if message.ExpiresAt.IsZero() || message.ExpiresAt.After(now) {
+			messages = append(messages, message)
+			continue
+		}
+
+		expired++
+		if c.deadLetterExpired {
+			c.pushDeadLetter(&message, "message expired")
+		}
+	}
+	c.messages = messages
+
+	if expired > 0 {
+		c.spaceAvailable.Broadcast()
+	}
+	return expired
+}
+
+// countExpiredMessages updates counters for expired messages.
+func (c *MemoryMessageQueue) countExpiredMessages(correlationId string, expired int) {
+	if expired == 0 {
+		return
+	}
+
+	c.Counters.Increment(c.counterKeys.expired, expired)
+	c.Logger.Debug(correlationId, "Discarded %d expired messages at %s", expired, c.Name())
+}
+
+// removeMessage removes a message at the given index from the queue.
+// Must be called under the lock.
+// Returns: the removed message.
+func (c *MemoryMessageQueue) removeMessage(index int) MessageEnvelope {
+	message := c.messages[index]
+	if index == 0 {
+		c.messages = c.messages[1:]
+	} else {
+		c.messages = append(c.messages[:index], c.messages[index+1:]...)
+	}
+	c.spaceAvailable.Broadcast()
+	return message
+}
+
+// notifyWhenVisible wakes up waiting receivers when a delayed message becomes visible.
+func (c *MemoryMessageQueue) notifyWhenVisible(delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		c.Lock.Lock()
+		c.messageAvailable.Broadcast()
+		c.Lock.Unlock()
+	})
+}
+
+// isDuplicate checks if a message with the same MessageId was already sent
+// within the deduplication window. Must be called under the lock.
+func (c *MemoryMessageQueue) isDuplicate(message *MessageEnvelope) bool {
+	if !c.dedupEnabled || message.MessageId == "" {
+		return false
+	}
+
+	expirationTime, ok := c.seenMessageIds[message.MessageId]
+	if !ok {
+		return false
+	}
+	if !expirationTime.After(c.clock()) {
+		delete(c.seenMessageIds, message.MessageId)
+		return false
+	}
+	return true
+}
+
+// rememberMessageId records MessageId of a sent message for deduplication.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) rememberMessageId(message *MessageEnvelope) {
+	if !c.dedupEnabled || message.MessageId == "" {
+		return
+	}
+	c.seenMessageIds[message.MessageId] = c.clock().Add(c.dedupTtl)
+}
+
+// releaseExpiredMessageIds forgets message ids with expired deduplication window.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) releaseExpiredMessageIds() {
+	now := c.clock()
+	for messageId, expirationTime := range c.seenMessageIds {
+		if !expirationTime.After(now) {
+			delete(c.seenMessageIds, messageId)
+		}
+	}
+}
+
+// waitForSpace waits until there is space for a new message in a bounded queue,
+// or returns ErrQueueOverflow in non-blocking mode. Positive timeout limits the wait
+// regardless of the mode and ErrSendTimeout is returned when it expires.
+// ErrQueueClosed is returned when the queue is closed while waiting.
+// Must be called under the lock.
+func (c *MemoryMessageQueue) waitForSpace(timeout time.Duration) error {
+	if c.capacity <= 0 || len(c.messages) < c.capacity {
+		return nil
+	}
+
+	if timeout > 0 {
+		// Wake up the waiting sender when the timeout expires
+		timer := time.AfterFunc(timeout, func() {
+			c.Lock.Lock()
+			c.spaceAvailable.Broadcast()
+			c.Lock.Unlock()
+		})
+		defer timer.Stop()
+
+		deadline := time.Now().Add(timeout)
+		for c.opened && len(c.messages) >= c.capacity && time.Now().Before(deadline) {
+			c.spaceAvailable.Wait()
+		}
+
+		if !c.opened {
+			return fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+		}
+		if len(c.messages) >= c.capacity {
+			return fmt.Errorf("%w: queue %s is full after %v", ErrSendTimeout, c.Name(), timeout)
+		}
+		return nil
+	}
+
+	for c.opened && c.sendBlocking && len(c.messages) >= c.capacity {
+		c.spaceAvailable.Wait()
+	}
+
+	if !c.opened {
+		return fmt.Errorf("%w: queue %s", ErrQueueClosed, c.Name())
+	}
+	if len(c.messages) >= c.capacity {
+		return fmt.Errorf("%w: queue %s has %d messages", ErrQueueOverflow, c.Name(), c.capacity)
+	}
+	return nil
+}
+
+// startLockReaper starts a background process that periodically returns
+// messages with expired locks back to the queue. Must be called under the lock.
+func (c *MemoryMessageQueue) startLockReaper() {
+	c.stopLockReaper()
+
+	if c.reaperInterval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.reaperStop = stop
+	interval := c.reaperInterval
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.Lock.Lock()
+				c.releaseExpiredLocks()
+				c.releaseExpiredMessageIds()
+				expired := c.discardExpiredMessages()
+				c.Lock.Unlock()
+
+				c.countExpiredMessages("", expired)
+			}
+		}
+	}()
+}
+
+// stopLockReaper stops the background lock reaper. Must be called under the lock.
+func (c *MemoryMessageQueue) stopLockReaper() {
+	if c.reaperStop != nil {
+		close(c.reaperStop)
+		c.reaperStop = nil
+	}
+}
+
+// startDepthSampler starts a background process that periodically records
+// the number of pending messages. Must be called under the lock.
+func (c *MemoryMessageQueue) startDepthSampler() {
+	c.stopDepthSampler()
+
+	if c.depthInterval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.depthStop = stop
+	interval := c.depthInterval
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.Lock.RLock()
+				depth := len(c.messages)
+				key := c.counterKeys.depth
+				c.Lock.RUnlock()
+
+				c.Counters.Stats(key, float32(depth))
+			}
+		}
+	}()
+}
+
+// stopDepthSampler stops the background depth sampler. Must be called under the lock.
+func (c *MemoryMessageQueue) stopDepthSampler() {
+	if c.depthStop != nil {
+		close(c.depthStop)
+		c.depthStop = nil
+	}
+}
+
+// releaseExpiredLocks returns messages with expired locks back to the queue.
+// Must be called under the lock.
+// Returns: number of released messages.
+func (c *MemoryMessageQueue) releaseExpiredLocks() int {
+	now := c.clock()
+	released := 0
+
+	for lockedToken, lockedMessage := range c.lockedMessages {
+		if lockedMessage.ExpirationTime.After(now) {
+			continue
+		}
+
+		c.unlockMessage(lockedToken)
+
+		// Envelope handed to the consumer is left untouched
+		message := *lockedMessage.Message
+		message.SetReference(nil)
+		c.requeueMessage(message, false)
+		released++
+	}
+
+	if released > 0 {
+		c.messageAvailable.Broadcast()
+	}
+
+	return released
 }
@@ -0,0 +1,263 @@
+package queues
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	ccount "github.com/pip-services3-go/pip-services3-components-go/count"
+	clog "github.com/pip-services3-go/pip-services3-components-go/log"
+)
+
+/*
+MemoryMessageTopic Message topic that delivers every sent message to all active subscribers
+within the same process by using shared memory.
+Unlike MemoryMessageQueue where consumers compete for messages, each subscriber
+receives its own copy of the message from a dedicated in-memory queue.
+This topic is typically used for testing to mock real pub/sub brokers.
+
+Configuration parameters:
+
+  - name:                        name of the message topic
+  - receive:
+    - poll_interval:             time in milliseconds a subscription waits for a message in one receive call (default: 100)
+    - lock_timeout:              lock timeout in milliseconds for messages passed to subscribers (default: 30000)
+
+References:
+
+- *:logger:*:*:1.0           (optional)  ILogger components to pass log messages
+- *:counters:*:*:1.0         (optional)  ICounters components to pass collected measurements
+
+See MemoryMessageQueue
+
+Example:
+
+    topic := NewMemoryMessageTopic("mytopic")
+    topic.Open("123")
+    subscriptionId, err := topic.Subscribe("123", receiver)
+    topic.Send("123", NewMessageEnvelope("", "mymessage", []byte("ABC")))
+    ...
+    topic.Unsubscribe(subscriptionId)
+*/
+type MemoryMessageTopic struct {
+	Logger        *clog.CompositeLogger
+	Counters      *ccount.CompositeCounters
+	lock          sync.RWMutex
+	name          string
+	subscriptions map[string]*memorySubscription
+	pollInterval  time.Duration
+	lockTimeout   time.Duration
+	opened        bool
+}
+
+// memorySubscription keeps a queue and a listening loop of a single subscriber.
+type memorySubscription struct {
+	queue   *MemoryMessageQueue
+	stopped int32
+	done    chan struct{}
+}
+
+// NewMemoryMessageTopic method are creates a new instance of the message topic.
+//   - name  (optional) a topic name.
+// Returns: *MemoryMessageTopic
+func NewMemoryMessageTopic(name string) *MemoryMessageTopic {
+	c := MemoryMessageTopic{
+		Logger:        clog.NewCompositeLogger(),
+		Counters:      ccount.NewCompositeCounters(),
+		name:          name,
+		subscriptions: make(map[string]*memorySubscription),
+		pollInterval:  100 * time.Millisecond,
+		lockTimeout:   30000 * time.Millisecond,
+		opened:        false,
+	}
+	return &c
+}
+
+// Name method are gets the topic name
+// Return the topic name.
+func (c *MemoryMessageTopic) Name() string {
+	return c.name
+}
+
+// Configure method are configures component by passing configuration parameters.
+//   - config    configuration parameters to be set.
+func (c *MemoryMessageTopic) Configure(config *cconf.ConfigParams) {
+	c.Logger.Configure(config)
+
+	c.name = cconf.NameResolver.ResolveWithDefault(config, c.name)
+	c.name = config.GetAsStringWithDefault("topic", c.name)
+
+	pollInterval := config.GetAsLongWithDefault("receive.poll_interval", int64(c.pollInterval/time.Millisecond))
+	c.pollInterval = time.Duration(pollInterval) * time.Millisecond
+
+	lockTimeout := config.GetAsLongWithDefault("receive.lock_timeout", int64(c.lockTimeout/time.Millisecond))
+	c.lockTimeout = time.Duration(lockTimeout) * time.Millisecond
+}
+
+// SetReferences mmethod are sets references to dependent components.
+//   - references 	references to locate the component dependencies.
+func (c *MemoryMessageTopic) SetReferences(references cref.IReferences) {
+	c.Logger.SetReferences(references)
+	c.Counters.SetReferences(references)
+}
+
+// IsOpen method are checks if the component is opened.
+// Return true if the component has been opened and false otherwise.
+func (c *MemoryMessageTopic) IsOpen() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.opened
+}
+
+// Open method are opens the component.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: error or null no errors occured.
+func (c *MemoryMessageTopic) Open(correlationId string) (err error) {
+	c.lock.Lock()
+	c.opened = true
+	c.lock.Unlock()
+
+	c.Logger.Trace(correlationId, "Opened topic %s", c.name)
+	return nil
+}
+
+// Close method are closes component and frees used resources.
+// All active subscriptions are cancelled.
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: error or nil no errors occured.
+func (c *MemoryMessageTopic) Close(correlationId string) (err error) {
+	c.lock.Lock()
+	subscriptions := c.subscriptions
+	c.subscriptions = make(map[string]*memorySubscription)
+	c.opened = false
+	c.lock.Unlock()
+
+	for _, subscription := range subscriptions {
+		c.stopSubscription(subscription)
+	}
+
+	c.Logger.Trace(correlationId, "Closed topic %s", c.name)
+	return nil
+}
+
+// ReadSubscriptionCount method are reads the current number of active subscriptions.
+// Returns: number of subscriptions.
+func (c *MemoryMessageTopic) ReadSubscriptionCount() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.subscriptions)
+}
+
+// Subscribe method are subscribes a receiver to all messages sent to the topic after the call.
+// Messages are passed to the receiver in a background thread one by one.
+// The receiver gets a subscription queue as a second parameter to complete or abandon the message.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - receiver          a receiver to receive incoming messages.
+// Returns: subscription id to be used to unsubscribe, or ErrQueueClosed error if the topic is closed.
+// See IMessageReceiver
+// See Unsubscribe
+func (c *MemoryMessageTopic) Subscribe(correlationId string, receiver IMessageReceiver) (subscriptionId string, err error) {
+	subscriptionId = cdata.IdGenerator.NextLong()
+	subscription := &memorySubscription{
+		queue: NewMemoryMessageQueue(c.name + "-" + subscriptionId),
+		done:  make(chan struct{}),
+	}
+	subscription.queue.Logger = c.Logger
+	subscription.queue.Counters = c.Counters
+
+	err = subscription.queue.Open(correlationId)
+	if err != nil {
+		return "", err
+	}
+
+	c.lock.Lock()
+	if !c.opened {
+		c.lock.Unlock()
+		subscription.queue.Close(correlationId)
+		return "", fmt.Errorf("%w: topic %s", ErrQueueClosed, c.name)
+	}
+	c.subscriptions[subscriptionId] = subscription
+	c.lock.Unlock()
+
+	go c.listenSubscription(correlationId, subscription, receiver)
+
+	c.Logger.Debug(correlationId, "Subscribed %s to topic %s", subscriptionId, c.name)
+	return subscriptionId, nil
+}
+
+// Unsubscribe method are cancels the subscription.
+// The method returns after the subscription stops delivering messages,
+// so it shall not be called from inside of a message receiver.
+// Messages that were not yet delivered to the subscriber are discarded.
+//   - subscriptionId    an id of the subscription returned by Subscribe.
+// Returns: error or nil for success.
+// See Subscribe
+func (c *MemoryMessageTopic) Unsubscribe(subscriptionId string) (err error) {
+	c.lock.Lock()
+	subscription, ok := c.subscriptions[subscriptionId]
+	delete(c.subscriptions, subscriptionId)
+	c.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: subscription %s", ErrSubscriptionNotFound, subscriptionId)
+	}
+
+	c.stopSubscription(subscription)
+
+	c.Logger.Debug("", "Unsubscribed %s from topic %s", subscriptionId, c.name)
+	return nil
+}
+
+// Send method are sends a message to all active subscribers.
+// Each subscriber receives its own copy of the message envelope.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - envelope          a message envelop to be sent.
+// Returns: error or nil for success, or ErrQueueClosed error if the topic is closed.
+func (c *MemoryMessageTopic) Send(correlationId string, envelope *MessageEnvelope) (err error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if !c.opened {
+		return fmt.Errorf("%w: topic %s", ErrQueueClosed, c.name)
+	}
+
+	envelope.SentTime = time.Now()
+
+	for _, subscription := range c.subscriptions {
+		err = subscription.queue.Send(correlationId, envelope.Clone())
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Counters.IncrementOne("topic." + c.name + ".sent_messages")
+	c.Logger.Debug(envelope.CorrelationId, "Sent message %s to %d subscribers of %s",
+		envelope.String(), len(c.subscriptions), c.name)
+
+	return nil
+}
+
+// listenSubscription receives messages from the subscription queue
+// and passes them to the receiver until the subscription is stopped.
+func (c *MemoryMessageTopic) listenSubscription(correlationId string,
+	subscription *memorySubscription, receiver IMessageReceiver) {
+	defer close(subscription.done)
+
+	receive := func() (*MessageEnvelope, error) {
+		return subscription.queue.receiveMatching(correlationId, c.pollInterval, c.lockTimeout, nil, nil)
+	}
+	subscription.queue.receiveLoop(correlationId, receiver, receive, &subscription.stopped, c.pollInterval, false)
+}
+
+// stopSubscription stops the listening loop of the subscription and closes its queue.
+func (c *MemoryMessageTopic) stopSubscription(subscription *memorySubscription) {
+	atomic.StoreInt32(&subscription.stopped, 1)
+	<-subscription.done
+	subscription.queue.Close("")
+}
@@ -1,15 +1,52 @@
 package queues
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	cconv "github.com/pip-services3-go/pip-services3-commons-go/convert"
 	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
 )
 
+const (
+	// ContentTypeHeader is a name of the message header that keeps the payload content type.
+	ContentTypeHeader = "Content-Type"
+	// ContentTypeJson is a content type of JSON payloads.
+	ContentTypeJson = "application/json"
+	// ContentTypeText is a content type of plain text payloads.
+	ContentTypeText = "text/plain"
+	// ContentTypeXml is a content type of XML payloads.
+	ContentTypeXml = "application/xml"
+	// ContentEncodingHeader is a name of the message header that keeps the payload compression algorithm.
+	ContentEncodingHeader = "Content-Encoding"
+	// ContentEncodingGzip is a content encoding of gzip compressed payloads.
+	ContentEncodingGzip = "gzip"
+	// ContentEncodingDeflate is a content encoding of payloads compressed by deflate in zlib format.
+	ContentEncodingDeflate = "deflate"
+	// ContentEncodingNone is a content encoding of payloads that are not compressed.
+	ContentEncodingNone = "none"
+	// TraceIdHeader is a name of the message header that keeps a distributed trace id.
+	TraceIdHeader = "trace_id"
+	// SpanIdHeader is a name of the message header that keeps a distributed trace span id.
+	SpanIdHeader = "span_id"
+	// DeadLetterReasonHeader is a name of the message header that keeps a reason
+	// why the message was moved to dead letter queue.
+	DeadLetterReasonHeader = "Dead-Letter-Reason"
+	// ReplyToHeader is a name of the message header that keeps a name of the queue
+	// where a reply to the message shall be sent.
+	ReplyToHeader = "Reply-To"
+)
+
 /*
 MessageEnvelope allows adding additional information to messages. A correlation id, message id, and a message type
 are added to the data being sent/received. Additionally, a MessageEnvelope can reference a lock token.
@@ -17,7 +54,8 @@ Side note: a MessageEnvelope"s message is stored as a buffer, so strings are con
 using utf8 conversions.
 */
 type MessageEnvelope struct {
-	reference interface{}
+	reference   interface{}
+	visibleTime time.Time
 
 	//The unique business transaction id that is used to trace calls across components.
 	CorrelationId string `json:"correlation_id"`
@@ -25,8 +63,20 @@ type MessageEnvelope struct {
 	MessageId string `json:"message_id"`
 	// String value that defines the stored message"s type.
 	MessageType string `json:"message_type"`
+	// The message group id. Messages of the same group are delivered one at a time in the order they were sent.
+	// Empty value means the message does not belong to any group.
+	GroupId string `json:"group_id"`
 	// The time at which the message was sent.
 	SentTime time.Time `json:"sent_time"`
+	// The time after which the message expires and is not delivered.
+	// Zero value means the message never expires.
+	ExpiresAt time.Time `json:"expires_at"`
+	// The message priority. Messages with higher priority are delivered first.
+	Priority int `json:"priority"`
+	// The number of times the message was delivered to receivers.
+	DeliveryCount int `json:"delivery_count"`
+	// Custom message properties like tenant id, content type or schema version.
+	Headers map[string]string `json:"headers"`
 	//The stored message.
 	Message []byte `json:"message"`
 }
@@ -53,6 +103,41 @@ func NewMessageEnvelope(correlationId string, messageType string, message []byte
 	return &c
 }
 
+// Clone method are creates a deep copy of this MessageEnvelope.
+// The copy does not reference the lock token of the original message.
+// Returns: *MessageEnvelope a cloned instance
+func (c *MessageEnvelope) Clone() *MessageEnvelope {
+	clone := *c
+	clone.reference = nil
+
+	if c.Message != nil {
+		clone.Message = make([]byte, len(c.Message))
+		copy(clone.Message, c.Message)
+	}
+
+	if c.Headers != nil {
+		clone.Headers = make(map[string]string, len(c.Headers))
+		for key, value := range c.Headers {
+			clone.Headers[key] = value
+		}
+	}
+
+	return &clone
+}
+
+// NewMessageEnvelopeFromJSON method are creates a new MessageEnvelope from its JSON representation.
+// It is the inverse of marshaling the envelope to JSON.
+//   - data     a JSON serialized envelope.
+// Returns: *MessageEnvelope new instance or ErrInvalidMessageEnvelope error if data is malformed.
+func NewMessageEnvelopeFromJSON(data []byte) (*MessageEnvelope, error) {
+	c := MessageEnvelope{}
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMessageEnvelope, err.Error())
+	}
+	return &c, nil
+}
+
 // GetReference method are returns the lock token that this MessageEnvelope references.
 func (c *MessageEnvelope) GetReference() interface{} {
 	return c.reference
@@ -64,6 +149,139 @@ func (c *MessageEnvelope) SetReference(value interface{}) {
 	c.reference = value
 }
 
+// WithCorrelationId method are sets the correlation id and returns the envelope to chain calls.
+//   - value     a correlation id.
+// Returns: this MessageEnvelope.
+func (c *MessageEnvelope) WithCorrelationId(value string) *MessageEnvelope {
+	c.CorrelationId = value
+	return c
+}
+
+// WithMessageType method are sets the message type and returns the envelope to chain calls.
+//   - value     a message type.
+// Returns: this MessageEnvelope.
+func (c *MessageEnvelope) WithMessageType(value string) *MessageEnvelope {
+	c.MessageType = value
+	return c
+}
+
+// WithMessageAsString method are stores the given string and returns the envelope to chain calls.
+//   - value     the string to set.
+// Returns: this MessageEnvelope.
+// See SetMessageAsString
+func (c *MessageEnvelope) WithMessageAsString(value string) *MessageEnvelope {
+	c.SetMessageAsString(value)
+	return c
+}
+
+// WithMessageAsJson method are stores the given value as a JSON string and returns the envelope to chain calls.
+//   - value     the value to convert to JSON and store in this message.
+// Returns: this MessageEnvelope.
+// See SetMessageAsJson
+func (c *MessageEnvelope) WithMessageAsJson(value interface{}) *MessageEnvelope {
+	c.SetMessageAsJson(value)
+	return c
+}
+
+// GetSentTime method are returns the time when the message was sent.
+// The time is set by the queue when the message is sent.
+func (c *MessageEnvelope) GetSentTime() time.Time {
+	return c.SentTime
+}
+
+// SetSentTime method are sets the time when the message was sent.
+//   - value     the time when the message was sent.
+func (c *MessageEnvelope) SetSentTime(value time.Time) {
+	c.SentTime = value
+}
+
+// GetContentType method are returns the content type of the message payload
+// stored in the "Content-Type" header.
+// Returns: the content type or empty string if it is not set.
+func (c *MessageEnvelope) GetContentType() string {
+	value, _ := c.GetHeader(ContentTypeHeader)
+	return value
+}
+
+// SetContentType method are sets the content type of the message payload
+// in the "Content-Type" header.
+//   - value     a content type like "application/json" or "text/plain".
+func (c *MessageEnvelope) SetContentType(value string) {
+	c.SetHeader(ContentTypeHeader, value)
+}
+
+// GetTraceContext method are returns the distributed trace context
+// stored in the "trace_id" and "span_id" headers.
+// Returns: the trace id and the span id, or empty strings if they are not set.
+func (c *MessageEnvelope) GetTraceContext() (traceId string, spanId string) {
+	traceId, _ = c.GetHeader(TraceIdHeader)
+	spanId, _ = c.GetHeader(SpanIdHeader)
+	return traceId, spanId
+}
+
+// SetTraceContext method are sets the distributed trace context
+// in the "trace_id" and "span_id" headers. Empty values remove the headers.
+//   - traceId   a trace id.
+//   - spanId    a span id.
+func (c *MessageEnvelope) SetTraceContext(traceId string, spanId string) {
+	if traceId == "" {
+		c.RemoveHeader(TraceIdHeader)
+	} else {
+		c.SetHeader(TraceIdHeader, traceId)
+	}
+	if spanId == "" {
+		c.RemoveHeader(SpanIdHeader)
+	} else {
+		c.SetHeader(SpanIdHeader, spanId)
+	}
+}
+
+// GetReplyTo method are returns a name of the queue where a reply to this message shall be sent.
+// By convention, a consumer sends the reply into that queue with the same correlation id,
+// so the requester can wait for it using MemoryMessageQueue.ReceiveReply.
+// Returns: the reply queue name or empty string if the message does not expect a reply.
+// See SetReplyTo
+func (c *MessageEnvelope) GetReplyTo() string {
+	value, _ := c.GetHeader(ReplyToHeader)
+	return value
+}
+
+// SetReplyTo method are sets a name of the queue where a reply to this message shall be sent
+// in the "Reply-To" header. An empty name removes the header.
+//   - queueName     a name of the reply queue.
+// See GetReplyTo
+func (c *MessageEnvelope) SetReplyTo(queueName string) {
+	if queueName == "" {
+		c.RemoveHeader(ReplyToHeader)
+	} else {
+		c.SetHeader(ReplyToHeader, queueName)
+	}
+}
+
+// GetHeader method are returns a value of the message header.
+//   - key     a header name.
+// Returns: the header value and true if the header is set.
+func (c *MessageEnvelope) GetHeader(key string) (string, bool) {
+	value, ok := c.Headers[key]
+	return value, ok
+}
+
+// SetHeader method are sets a value of the message header.
+//   - key     a header name.
+//   - value   a header value.
+func (c *MessageEnvelope) SetHeader(key string, value string) {
+	if c.Headers == nil {
+		c.Headers = map[string]string{}
+	}
+	c.Headers[key] = value
+}
+
+// RemoveHeader method are removes the message header.
+//   - key     a header name.
+func (c *MessageEnvelope) RemoveHeader(key string) {
+	delete(c.Headers, key)
+}
+
 // GetMessageAsString method are returns the information stored in this message as a string.
 func (c *MessageEnvelope) GetMessageAsString() string {
 	return string(c.Message)
@@ -73,6 +291,7 @@ func (c *MessageEnvelope) GetMessageAsString() string {
 //   - value    the string to set. Will be converted to a bufferg.
 func (c *MessageEnvelope) SetMessageAsString(value string) {
 	c.Message = []byte(value)
+	c.SetContentType(ContentTypeText)
 }
 
 // GetMessageAsJson method are returns the value that was stored in this message as a JSON string.
@@ -89,6 +308,78 @@ func (c *MessageEnvelope) SetMessageAsJson(value interface{}) {
 	c.SetMessageAsObject(value)
 }
 
+// GetMessageAsJsonWithError method are returns the value that was stored in this message as a JSON string.
+// Unlike GetMessageAsJson it reports errors when the message cannot be decoded.
+// Returns: the value or error.
+// See  SetMessageAsJsonWithError
+func (c *MessageEnvelope) GetMessageAsJsonWithError() (interface{}, error) {
+	contentType := c.GetContentType()
+	if contentType != "" && contentType != ContentTypeJson {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedContentType, contentType)
+	}
+
+	if len(c.Message) == 0 {
+		return nil, nil
+	}
+
+	var value interface{}
+	err := json.Unmarshal(c.Message, &value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// SetMessageAsJsonWithError method are stores the given value as a JSON string.
+// Unlike SetMessageAsJson it reports errors when the value cannot be converted to JSON.
+// On error the message is not changed.
+//   - value     the value to convert to JSON and store in this message.
+// Returns: error or nil for success.
+// See  GetMessageAsJsonWithError
+func (c *MessageEnvelope) SetMessageAsJsonWithError(value interface{}) error {
+	if value == nil {
+		c.Message = []byte{}
+		return nil
+	}
+
+	message, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	c.Message = message
+	c.SetContentType(ContentTypeJson)
+	return nil
+}
+
+// GetMessageAsXml method are decodes the XML payload of this message into the target value.
+//   - target    a pointer to the value to decode the payload into.
+// Returns: error or nil for success. ErrUnexpectedContentType is returned
+// when the message content type is set and it is not XML.
+// See  SetMessageAsXml
+func (c *MessageEnvelope) GetMessageAsXml(target interface{}) error {
+	contentType := c.GetContentType()
+	if contentType != "" && contentType != ContentTypeXml {
+		return fmt.Errorf("%w: %s", ErrUnexpectedContentType, contentType)
+	}
+
+	return xml.Unmarshal(c.Message, target)
+}
+
+// SetMessageAsXml method are stores the given value as an XML string.
+// On error the message is not changed.
+//   - value     the value to convert to XML and store in this message.
+// Returns: error or nil for success.
+// See  GetMessageAsXml
+func (c *MessageEnvelope) SetMessageAsXml(value interface{}) error {
+	message, err := xml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	c.Message = message
+	c.SetContentType(ContentTypeXml)
+	return nil
+}
+
 // GetMessageAs method are returns the value that was stored in this message as object.
 // See  SetMessageAsObject
 func (c *MessageEnvelope) GetMessageAs(value interface{}) interface{} {
@@ -114,8 +405,183 @@ func (c *MessageEnvelope) SetMessageAsObject(value interface{}) {
 		message, err := json.Marshal(value)
 		if err == nil {
 			c.Message = message
+			c.SetContentType(ContentTypeJson)
+		}
+	}
+}
+
+// GetMessageAsCompressedJson method are returns the value that was stored in this message as a gzip compressed JSON.
+// Returns: the value or error if the message is not compressed or cannot be decoded.
+// See  SetMessageAsCompressedJson
+func (c *MessageEnvelope) GetMessageAsCompressedJson() (interface{}, error) {
+	encoding, _ := c.GetHeader(ContentEncodingHeader)
+	if encoding != ContentEncodingGzip {
+		return nil, ErrMessageNotCompressed
+	}
+
+	buffer, err := c.GetMessageDecompressed()
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	err = json.Unmarshal(buffer, &value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// SetMessageAsCompressedJson method are stores the given value as a gzip compressed JSON
+// and sets Content-Encoding header to gzip.
+//   - value     the value to convert to JSON, compress and store in this message.
+// Returns: error or nil for success.
+// See  GetMessageAsCompressedJson
+func (c *MessageEnvelope) SetMessageAsCompressedJson(value interface{}) error {
+	message, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetMessageCompressed(message, ContentEncodingGzip)
+	if err != nil {
+		return err
+	}
+
+	c.SetContentType(ContentTypeJson)
+	return nil
+}
+
+// GetMessageDecompressed method are returns the message payload decompressed
+// according to the Content-Encoding header: gzip, deflate or none.
+// Payloads without the header are returned as is.
+// Returns: the decompressed payload or ErrUnsupportedEncoding error if the encoding is unknown.
+// See SetMessageCompressed
+func (c *MessageEnvelope) GetMessageDecompressed() ([]byte, error) {
+	encoding, _ := c.GetHeader(ContentEncodingHeader)
+
+	var reader io.ReadCloser
+	var err error
+	switch strings.ToLower(encoding) {
+	case "", ContentEncodingNone, "identity":
+		return c.Message, nil
+	case ContentEncodingGzip:
+		reader, err = gzip.NewReader(bytes.NewReader(c.Message))
+	case ContentEncodingDeflate:
+		reader, err = zlib.NewReader(bytes.NewReader(c.Message))
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// SetMessageCompressed method are compresses the given payload, stores it in this message
+// and sets Content-Encoding header to the algorithm.
+// For none or empty algorithm the payload is stored as is and the header is removed.
+//   - value     the payload to compress and store in this message.
+//   - algo      a compression algorithm: gzip, deflate or none.
+// Returns: error or ErrUnsupportedEncoding if the algorithm is unknown.
+// See GetMessageDecompressed
+func (c *MessageEnvelope) SetMessageCompressed(value []byte, algo string) error {
+	algo = strings.ToLower(algo)
+
+	buffer := bytes.Buffer{}
+	var writer io.WriteCloser
+	switch algo {
+	case "", ContentEncodingNone:
+		c.Message = value
+		c.RemoveHeader(ContentEncodingHeader)
+		return nil
+	case ContentEncodingGzip:
+		writer = gzip.NewWriter(&buffer)
+	case ContentEncodingDeflate:
+		writer = zlib.NewWriter(&buffer)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedEncoding, algo)
+	}
+
+	_, err := writer.Write(value)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	c.Message = buffer.Bytes()
+	c.SetHeader(ContentEncodingHeader, algo)
+	return nil
+}
+
+// Size method are estimates a memory footprint of this message in bytes.
+// It includes the payload, identifiers, message type, group id and headers.
+// Returns: an estimated size in bytes.
+func (c *MessageEnvelope) Size() int {
+	size := len(c.Message) + len(c.MessageId) + len(c.CorrelationId) + len(c.MessageType) + len(c.GroupId)
+	for key, value := range c.Headers {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+// EqualsContent method are checks if this message has the same content as another message.
+// Only correlation id, message type and payload are compared, so it is handy in tests
+// to compare received messages with expected ones regardless of ids, times and lock tokens.
+//   - other     a message to compare with.
+// Returns: true if messages have the same content and false otherwise.
+func (c *MessageEnvelope) EqualsContent(other *MessageEnvelope) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	return c.CorrelationId == other.CorrelationId &&
+		c.MessageType == other.MessageType &&
+		bytes.Equal(c.Message, other.Message)
+}
+
+// Equals method are checks if all public fields of this message are equal to the fields of another message.
+// Sent and expiration times are compared as time instants. The lock token reference is not compared.
+//   - other     a message to compare with.
+// Returns: true if messages are equal and false otherwise.
+func (c *MessageEnvelope) Equals(other *MessageEnvelope) bool {
+	if !c.EqualsContent(other) {
+		return false
+	}
+	if c == nil {
+		return true
+	}
+	if c.MessageId != other.MessageId || c.GroupId != other.GroupId || !c.SentTime.Equal(other.SentTime) || !c.ExpiresAt.Equal(other.ExpiresAt) ||
+		c.Priority != other.Priority || c.DeliveryCount != other.DeliveryCount || len(c.Headers) != len(other.Headers) {
+		return false
+	}
+	for key, value := range c.Headers {
+		if otherValue, ok := other.Headers[key]; !ok || otherValue != value {
+			return false
 		}
 	}
+	return true
+}
+
+// Validate method are checks that the message has all required fields:
+// a message id, a message type and a message payload.
+// Returns: a list of validation errors or empty list if the message is valid.
+func (c *MessageEnvelope) Validate() []error {
+	errs := make([]error, 0)
+	if c.MessageId == "" {
+		errs = append(errs, fmt.Errorf("%w: message id is not set", ErrInvalidMessageEnvelope))
+	}
+	if c.MessageType == "" {
+		errs = append(errs, fmt.Errorf("%w: message type is not set", ErrInvalidMessageEnvelope))
+	}
+	if c.Message == nil {
+		errs = append(errs, fmt.Errorf("%w: message payload is not set", ErrInvalidMessageEnvelope))
+	}
+	return errs
 }
 
 // String method are convert"s this MessageEnvelope to a string, using the following format:
@@ -151,6 +617,12 @@ func (c *MessageEnvelope) MarshalJSON() ([]byte, error) {
 		"message_id":     c.MessageId,
 		"correlation_id": c.CorrelationId,
 		"message_type":   c.MessageType,
+		"priority":       c.Priority,
+		"delivery_count": c.DeliveryCount,
+	}
+
+	if c.GroupId != "" {
+		jsonData["group_id"] = c.GroupId
 	}
 
 	if !c.SentTime.IsZero() {
@@ -159,10 +631,25 @@ func (c *MessageEnvelope) MarshalJSON() ([]byte, error) {
 		jsonData["sent_time"] = time.Now()
 	}
 
+	if !c.ExpiresAt.IsZero() {
+		jsonData["expires_at"] = c.ExpiresAt
+	}
+
+	if len(c.Headers) > 0 {
+		jsonData["headers"] = c.Headers
+	}
+
 	if c.Message != nil {
-		base64Text := make([]byte, base64.StdEncoding.EncodedLen(len(c.Message)))
-		base64.StdEncoding.Encode(base64Text, []byte(c.Message))
-		jsonData["message"] = string(base64Text)
+		// Keep text payloads readable and encode binary ones as base64
+		if utf8.Valid(c.Message) {
+			jsonData["message"] = string(c.Message)
+			jsonData["message_encoding"] = "utf8"
+		} else {
+			base64Text := make([]byte, base64.StdEncoding.EncodedLen(len(c.Message)))
+			base64.StdEncoding.Encode(base64Text, []byte(c.Message))
+			jsonData["message"] = string(base64Text)
+			jsonData["message_encoding"] = "base64"
+		}
 	}
 
 	return json.Marshal(jsonData)
@@ -175,15 +662,35 @@ func (c *MessageEnvelope) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	c.MessageId = jsonData["message_id"].(string)
-	c.CorrelationId = jsonData["correlation_id"].(string)
-	c.MessageType = jsonData["message_type"].(string)
+	c.MessageId = cconv.StringConverter.ToString(jsonData["message_id"])
+	c.CorrelationId = cconv.StringConverter.ToString(jsonData["correlation_id"])
+	c.MessageType = cconv.StringConverter.ToString(jsonData["message_type"])
+	if jsonData["group_id"] != nil {
+		c.GroupId = cconv.StringConverter.ToString(jsonData["group_id"])
+	}
 	c.SentTime = cconv.DateTimeConverter.ToDateTime(jsonData["sent_time"])
+	if jsonData["expires_at"] != nil {
+		c.ExpiresAt = cconv.DateTimeConverter.ToDateTime(jsonData["expires_at"])
+	}
+	c.Priority = cconv.IntegerConverter.ToInteger(jsonData["priority"])
+	c.DeliveryCount = cconv.IntegerConverter.ToInteger(jsonData["delivery_count"])
+
+	headers, ok := jsonData["headers"].(map[string]interface{})
+	if ok {
+		c.Headers = make(map[string]string, len(headers))
+		for key, value := range headers {
+			c.Headers[key] = cconv.StringConverter.ToString(value)
+		}
+	}
 
-	base64Text, ok := jsonData["message"].(string)
-	if ok && base64Text != "" {
-		data := make([]byte, base64.StdEncoding.DecodedLen(len(base64Text)))
-		len, err := base64.StdEncoding.Decode(data, []byte(base64Text))
+	messageText, ok := jsonData["message"].(string)
+	encoding, _ := jsonData["message_encoding"].(string)
+	if ok && encoding == "utf8" {
+		c.Message = []byte(messageText)
+	} else if ok && messageText != "" {
+		// Messages without encoding are always base64 encoded
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(messageText)))
+		len, err := base64.StdEncoding.Decode(data, []byte(messageText))
 		if err != nil {
 			return err
 		}
@@ -192,3 +699,12 @@ func (c *MessageEnvelope) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// messageCorrelationId gets the correlation id of the message
+// or the default correlation id when the message has none.
+func messageCorrelationId(message *MessageEnvelope, defaultCorrelationId string) string {
+	if message != nil && message.CorrelationId != "" {
+		return message.CorrelationId
+	}
+	return defaultCorrelationId
+}
@@ -1,7 +1,11 @@
 package queues
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
 	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
@@ -55,7 +59,7 @@ type MessageQueue struct {
 	Counters           *ccount.CompositeCounters
 	ConnectionResolver *cconn.ConnectionResolver
 	CredentialResolver *cauth.CredentialResolver
-	Lock               sync.Mutex
+	Lock               sync.RWMutex
 	name               string
 	capabilities       *MessagingCapabilities
 }
@@ -76,7 +80,7 @@ func InheritMessageQueue(overrides IMessageQueueOverrides, name string, capabili
 	c.CredentialResolver = cauth.NewEmptyCredentialResolver()
 
 	if c.capabilities == nil {
-		NewMessagingCapabilities(false, false, false, false, false, false, false, false, false)
+		c.capabilities = NewMessagingCapabilities(false, false, false, false, false, false, false, false, false)
 	}
 
 	return &c
@@ -165,11 +169,15 @@ func (c *MessageQueue) CheckOpen(correlationId string) error {
 //   - correlationId     (optional) transaction id to trace execution through call chain.
 //   - messageType       a message type
 //   - value             an object value to be sent
-// Returns: error or null for success.
+// Returns: error or null for success. If the value cannot be converted into JSON
+// the marshaling error is returned and nothing is sent.
 // See Send
 func (c *MessageQueue) SendAsObject(correlationId string, messageType string, message interface{}) (err error) {
 	envelope := NewMessageEnvelope(correlationId, messageType, nil)
-	envelope.SetMessageAsJson(message)
+	err = envelope.SetMessageAsJsonWithError(message)
+	if err != nil {
+		return err
+	}
 	return c.Overrides.Send(correlationId, envelope)
 }
 
@@ -187,6 +195,76 @@ func (c *MessageQueue) BeginListen(correlationId string, receiver IMessageReceiv
 	}()
 }
 
+// receiveLoop receives messages with the given function and passes them to the receiver
+// until the cancellation flag is set. It is shared by queues that implement Listen on top of receive calls.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - receiver          a receiver to receive incoming messages.
+//   - receive           a function that waits for the next message and locks it.
+//   - cancel            a cancellation flag that stops the loop when set to non-zero.
+//   - retryInterval     a time to wait after a failed receive or while the queue is closed.
+//   - autoAck           true to complete or abandon messages after the receiver returns.
+func (c *MessageQueue) receiveLoop(correlationId string, receiver IMessageReceiver,
+	receive func() (*MessageEnvelope, error), cancel *int32, retryInterval time.Duration, autoAck bool) {
+	for atomic.LoadInt32(cancel) == 0 {
+		message, err := receive()
+		if errors.Is(err, ErrQueueClosed) {
+			// Wait until the queue is opened
+			time.Sleep(retryInterval)
+			continue
+		}
+		if err != nil {
+			c.Logger.Error(correlationId, err, "Failed to receive the message")
+			if message == nil {
+				time.Sleep(retryInterval)
+				continue
+			}
+		}
+
+		if message != nil && atomic.LoadInt32(cancel) == 0 {
+			c.processMessage(correlationId, receiver, message, autoAck)
+		}
+	}
+}
+
+// processMessage passes a received message to the receiver.
+// When the receiver panics the message is returned to the queue to retry.
+func (c *MessageQueue) processMessage(correlationId string, receiver IMessageReceiver,
+	message *MessageEnvelope, autoAck bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Sprintf("%v", r)
+			c.Logger.Error(messageCorrelationId(message, correlationId), nil, "Failed to process the message - "+err)
+
+			// Return the message to the queue to retry, unless the receiver already released it
+			c.Overrides.Abandon(message)
+		}
+	}()
+
+	err := receiver.ReceiveMessage(message, c.Overrides)
+	if err != nil {
+		c.Logger.Error(messageCorrelationId(message, correlationId), err, "Failed to process the message")
+	}
+
+	if autoAck {
+		c.acknowledgeMessage(correlationId, message, err)
+	}
+}
+
+// acknowledgeMessage completes successfully processed message or abandons it on error,
+// unless the receiver already released the message.
+func (c *MessageQueue) acknowledgeMessage(correlationId string, message *MessageEnvelope, processErr error) {
+	var err error
+	if processErr == nil {
+		err = c.Overrides.Complete(message)
+	} else {
+		err = c.Overrides.Abandon(message)
+	}
+
+	if err != nil && !errors.Is(err, ErrMessageNotLocked) && !errors.Is(err, ErrMessageNotReceived) {
+		c.Logger.Error(messageCorrelationId(message, correlationId), err, "Failed to acknowledge the message")
+	}
+}
+
 // String method are gets a string representation of the object.
 // Return a string representation of the object.
 func (c *MessageQueue) String() string {
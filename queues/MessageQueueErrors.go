@@ -0,0 +1,102 @@
+package queues
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrQueueOverflow is returned by Send when a bounded queue is full
+// and the queue is not configured to block until space is available.
+var ErrQueueOverflow = errors.New("message queue is full")
+
+// ErrSendTimeout is returned by SendWithTimeout when a bounded queue stays full
+// for the whole timeout.
+var ErrSendTimeout = errors.New("timeout waiting for space in message queue")
+
+// ErrMessageNotFound is returned when a requested message is not found in the queue.
+var ErrMessageNotFound = errors.New("message is not found")
+
+// ErrMessageNotCompressed is returned when a compressed payload is read from a message
+// that is not marked as compressed.
+var ErrMessageNotCompressed = errors.New("message is not compressed")
+
+// ErrUnsupportedEncoding is returned when a message payload is compressed
+// or decompressed with an unknown content encoding.
+var ErrUnsupportedEncoding = errors.New("unsupported message content encoding")
+
+// ErrMessageNotLocked is returned when a message is not locked by the queue,
+// for instance when it was already completed or was never received.
+var ErrMessageNotLocked = errors.New("message is not locked")
+
+// ErrMessageNotReceived is returned when a message that was never received from the queue
+// or was already completed or abandoned is passed to complete or abandon it.
+// It wraps ErrMessageNotLocked.
+var ErrMessageNotReceived = fmt.Errorf("%w: message was not received", ErrMessageNotLocked)
+
+// ErrLockExpired is returned when a message lock has expired.
+// The message is returned back to the queue to be received again.
+var ErrLockExpired = errors.New("message lock has expired")
+
+// ErrInvalidMessageEnvelope is returned when a message envelope cannot be restored from its serialized form
+// or when it misses required fields.
+var ErrInvalidMessageEnvelope = errors.New("invalid message envelope")
+
+// ErrCloseTimeout is returned by graceful close when received messages
+// were not completed or abandoned within the timeout.
+var ErrCloseTimeout = errors.New("timeout waiting for in-flight messages")
+
+// ErrSubscriptionNotFound is returned when a topic subscription with the given id does not exist.
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// ErrUnexpectedContentType is returned when a message payload is read in a format
+// that does not match the content type set on the message.
+var ErrUnexpectedContentType = errors.New("unexpected message content type")
+
+// ErrAlreadyListening is returned by Listen when the queue already has an active listener.
+// Use ListenWithWorkers to process messages by multiple concurrent workers.
+var ErrAlreadyListening = errors.New("queue is already listened")
+
+// ErrNoChildQueues is returned by a composite queue that has no child queues to send or receive messages.
+var ErrNoChildQueues = errors.New("queue has no child queues")
+
+// ErrInvalidQueueName is returned when a queue name is empty
+// or contains characters that are not allowed in counter keys.
+var ErrInvalidQueueName = errors.New("invalid queue name")
+
+// ErrMessageTooLarge is returned by Send when a message payload exceeds the maximum message size.
+var ErrMessageTooLarge = errors.New("message is too large")
+
+// ErrQueueClosed is returned when a message queue is used before it is opened or after it is closed.
+var ErrQueueClosed = errors.New("message queue is not opened")
+
+// BatchError is returned by batch operations when some of the messages failed to process.
+// Errors are stored in the same order as messages passed to the operation,
+// with nil for messages that were processed successfully.
+type BatchError struct {
+	Errors []error
+}
+
+// Error method are gets a description of the failed batch operation.
+func (e *BatchError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return fmt.Sprintf("%d of %d messages failed: %v", failed, len(e.Errors), first)
+}
+
+// Is method are checks if any of the message errors matches the target.
+func (e *BatchError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if err != nil && errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package queues
+
+// MessagingCapabilitiesBuilder helper that creates MessagingCapabilities by setting capabilities by name.
+// All capabilities are disabled by default.
+//
+// Example:
+//
+//     capabilities := NewMessagingCapabilitiesBuilder().
+//         WithSend(true).
+//         WithReceive(true).
+//         Build()
+//
+// See MessagingCapabilities
+type MessagingCapabilitiesBuilder struct {
+	capabilities MessagingCapabilities
+}
+
+// NewMessagingCapabilitiesBuilder method are creates a new instance of the capabilities builder.
+// Returns *MessagingCapabilitiesBuilder
+func NewMessagingCapabilitiesBuilder() *MessagingCapabilitiesBuilder {
+	return &MessagingCapabilitiesBuilder{}
+}
+
+// WithMessageCount method are sets if the queue supports reading message count.
+//   - value   true if queue supports reading message count.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithMessageCount(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canMessageCount = value
+	return c
+}
+
+// WithSend method are sets if the queue is able to send messages.
+//   - value   true if queue is able to send messages.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithSend(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canSend = value
+	return c
+}
+
+// WithReceive method are sets if the queue is able to receive messages.
+//   - value   true if queue is able to receive messages.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithReceive(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canReceive = value
+	return c
+}
+
+// WithPeek method are sets if the queue is able to peek messages.
+//   - value   true if queue is able to peek messages.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithPeek(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canPeek = value
+	return c
+}
+
+// WithPeekBatch method are sets if the queue is able to peek multiple messages in one batch.
+//   - value   true if queue is able to peek multiple messages in one batch.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithPeekBatch(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canPeekBatch = value
+	return c
+}
+
+// WithRenewLock method are sets if the queue is able to renew message lock.
+//   - value   true if queue is able to renew message lock.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithRenewLock(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canRenewLock = value
+	return c
+}
+
+// WithAbandon method are sets if the queue is able to abandon messages.
+//   - value   true if queue is able to abandon messages.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithAbandon(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canAbandon = value
+	return c
+}
+
+// WithDeadLetter method are sets if the queue is able to send messages to dead letter queue.
+//   - value   true if queue is able to send messages to dead letter queue.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithDeadLetter(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canDeadLetter = value
+	return c
+}
+
+// WithClear method are sets if the queue can be cleared.
+//   - value   true if queue can be cleared.
+// Returns: the builder to chain calls.
+func (c *MessagingCapabilitiesBuilder) WithClear(value bool) *MessagingCapabilitiesBuilder {
+	c.capabilities.canClear = value
+	return c
+}
+
+// Build method are creates capabilities object with the configured values.
+// Returns *MessagingCapabilities
+func (c *MessagingCapabilitiesBuilder) Build() *MessagingCapabilities {
+	capabilities := c.capabilities
+	return &capabilities
+}
@@ -0,0 +1,79 @@
+package queues
+
+import "sync"
+
+// MockMessageReceiver message receiver that records received messages.
+// It is used in tests to verify messages delivered by a queue.
+// The receiver does not complete or abandon messages, it is left to the caller
+// or to the queue listening in auto acknowledgement mode.
+// When an error is set, the receiver records messages and returns the error
+// to simulate processing failures.
+// The receiver is safe to use from multiple listening threads.
+//
+// Example:
+//
+//     receiver := NewMockMessageReceiver()
+//     go queue.Listen("123", receiver)
+//     ...
+//     fmt.Println(receiver.Count())
+type MockMessageReceiver struct {
+	lock     sync.Mutex
+	messages []*MessageEnvelope
+	err      error
+}
+
+// NewMockMessageReceiver method are creates a new instance of the mock receiver.
+// Returns: *MockMessageReceiver
+func NewMockMessageReceiver() *MockMessageReceiver {
+	c := MockMessageReceiver{
+		messages: make([]*MessageEnvelope, 0),
+	}
+	return &c
+}
+
+// SetError method are sets an error to be returned for received messages.
+//   - err   an error to simulate failures or nil to process messages successfully.
+func (c *MockMessageReceiver) SetError(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.err = err
+}
+
+// ReceiveMessage method are records incoming message.
+//   - message   an incoming message
+//   - queue     a queue where the message comes from
+// Returns: the configured error or nil.
+func (c *MockMessageReceiver) ReceiveMessage(message *MessageEnvelope, queue IMessageQueue) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.messages = append(c.messages, message)
+	return c.err
+}
+
+// Messages method are gets all received messages in the order they were received.
+// Returns: a copy of the list of received messages.
+func (c *MockMessageReceiver) Messages() []*MessageEnvelope {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]*MessageEnvelope{}, c.messages...)
+}
+
+// Count method are gets the number of received messages.
+// Returns: the number of received messages.
+func (c *MockMessageReceiver) Count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.messages)
+}
+
+// Clear method are removes all recorded messages.
+func (c *MockMessageReceiver) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.messages = make([]*MessageEnvelope, 0)
+}
@@ -0,0 +1,28 @@
+package queues
+
+import "time"
+
+// QueueSnapshot data object that contains a read-only copy of all messages in a message queue
+// taken at one moment of time. It is mostly used for debugging.
+// See: MemoryMessageQueue
+type QueueSnapshot struct {
+	// The time when the snapshot was taken.
+	Time time.Time `json:"time"`
+	// The messages waiting in the queue to be delivered, in delivery order.
+	Messages []*MessageEnvelope `json:"messages"`
+	// The received messages that are locked and not yet completed, ordered by lock token.
+	LockedMessages []*LockedMessageSnapshot `json:"locked_messages"`
+	// The messages in the dead letter queue.
+	DeadLetters []*MessageEnvelope `json:"dead_letters"`
+}
+
+// LockedMessageSnapshot data object that contains a copy of a locked message in QueueSnapshot.
+// See: QueueSnapshot
+type LockedMessageSnapshot struct {
+	// The lock token of the message.
+	LockToken int `json:"lock_token"`
+	// The locked message.
+	Message *MessageEnvelope `json:"message"`
+	// The expiration time for the message lock.
+	ExpirationTime time.Time `json:"expiration_time"`
+}
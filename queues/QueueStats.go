@@ -0,0 +1,18 @@
+package queues
+
+// QueueStats data object that contains runtime statistics of a message queue.
+// See: MemoryMessageQueue
+type QueueStats struct {
+	// The number of messages waiting in the queue to be delivered.
+	PendingCount int64 `json:"pending_count"`
+	// The number of received messages that are locked and not yet completed.
+	LockedCount int64 `json:"locked_count"`
+	// The number of messages in the dead letter queue.
+	DeadCount int64 `json:"dead_count"`
+	// The total number of messages sent since the queue was opened.
+	TotalSent int64 `json:"total_sent"`
+	// The total number of messages received since the queue was opened.
+	TotalReceived int64 `json:"total_received"`
+	// The total number of messages moved to dead letter queue since the queue was opened.
+	TotalDead int64 `json:"total_dead"`
+}
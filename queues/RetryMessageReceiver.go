@@ -0,0 +1,60 @@
+package queues
+
+import "time"
+
+// RetryMessageReceiver decorates IMessageReceiver to retry failed messages with exponential backoff.
+// When the wrapped receiver returns an error, the message is passed to it again after a delay
+// that starts from the base delay and grows by the multiplier after each attempt.
+// When all retries fail the last error is returned, so a queue listening in auto acknowledgment mode
+// abandons the message. Total time of retries shall fit into the message lock timeout.
+//
+// Example:
+//
+//     receiver := NewRetryMessageReceiver(myReceiver, 3, 100*time.Millisecond, 2)
+//     go queue.Listen("123", receiver)
+type RetryMessageReceiver struct {
+	// The wrapped receiver.
+	Receiver IMessageReceiver
+	// The maximum number of retries after the first failed attempt.
+	MaxRetries int
+	// The delay before the first retry.
+	BaseDelay time.Duration
+	// The factor to increase the delay after each retry. Values less than 1 keep the delay constant.
+	Multiplier float64
+}
+
+// NewRetryMessageReceiver method are creates a new receiver that retries the wrapped receiver.
+//   - receiver      a receiver to process incoming messages.
+//   - maxRetries    a maximum number of retries after the first failed attempt.
+//   - baseDelay     a delay before the first retry.
+//   - multiplier    a factor to increase the delay after each retry.
+// Returns: *RetryMessageReceiver
+func NewRetryMessageReceiver(receiver IMessageReceiver, maxRetries int,
+	baseDelay time.Duration, multiplier float64) *RetryMessageReceiver {
+	c := RetryMessageReceiver{
+		Receiver:   receiver,
+		MaxRetries: maxRetries,
+		BaseDelay:  baseDelay,
+		Multiplier: multiplier,
+	}
+	return &c
+}
+
+// ReceiveMessage method are passes incoming message to the wrapped receiver and retries it on errors.
+//   - message   an incoming message
+//   - queue     a queue where the message comes from
+// Returns: nil if one of attempts succeeded or error returned by the last attempt.
+func (c *RetryMessageReceiver) ReceiveMessage(message *MessageEnvelope, queue IMessageQueue) (err error) {
+	delay := c.BaseDelay
+	for attempt := 0; ; attempt++ {
+		err = c.Receiver.ReceiveMessage(message, queue)
+		if err == nil || attempt >= c.MaxRetries {
+			return err
+		}
+
+		time.Sleep(delay)
+		if c.Multiplier > 1 {
+			delay = time.Duration(float64(delay) * c.Multiplier)
+		}
+	}
+}
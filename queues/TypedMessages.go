@@ -0,0 +1,46 @@
+package queues
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SendTyped function are sends a value as a JSON encoded message into the queue.
+//   - queue             a message queue to send the message to.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - messageType       a message type.
+//   - value             a value to be sent.
+// Returns: error or nil for success.
+func SendTyped[T any](queue IMessageQueue, correlationId string, messageType string, value T) error {
+	envelope := NewMessageEnvelope(correlationId, messageType, nil)
+	err := envelope.SetMessageAsJsonWithError(value)
+	if err != nil {
+		return err
+	}
+
+	return queue.Send(correlationId, envelope)
+}
+
+// ReceiveTyped function are receives a message from the queue and decodes its JSON payload into a value.
+// The received message shall be completed or abandoned as usual.
+// When decoding fails the message stays locked and is returned along with the error.
+//   - queue             a message queue to receive the message from.
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - waitTimeout       a timeout in milliseconds to wait for a message to come.
+// Returns: a decoded value and the received message, nils if no message came, or error.
+func ReceiveTyped[T any](queue IMessageQueue, correlationId string,
+	waitTimeout time.Duration) (*T, *MessageEnvelope, error) {
+	envelope, err := queue.Receive(correlationId, waitTimeout)
+	if err != nil || envelope == nil {
+		return nil, nil, err
+	}
+
+	value := new(T)
+	err = json.Unmarshal(envelope.Message, value)
+	if err != nil {
+		return nil, envelope, fmt.Errorf("failed to decode message %s as %T: %w", envelope.MessageId, *value, err)
+	}
+
+	return value, envelope, nil
+}
@@ -0,0 +1,33 @@
+package test_build
+
+import (
+	"testing"
+
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	build "github.com/pip-services3-go/pip-services3-messaging-go/build"
+	queues "github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultMessagingFactory(t *testing.T) {
+	factory := build.NewDefaultMessagingFactory()
+
+	queueDescriptor := cref.NewDescriptor("pip-services", "message-queue", "memory", "test", "1.0")
+	assert.NotNil(t, factory.CanCreate(queueDescriptor))
+
+	comp, err := factory.Create(queueDescriptor)
+	assert.Nil(t, err)
+	queue, ok := comp.(*queues.MemoryMessageQueue)
+	assert.True(t, ok)
+	assert.Equal(t, "test", queue.Name())
+
+	factoryDescriptor := cref.NewDescriptor("pip-services", "queue-factory", "memory", "default", "1.0")
+	comp, err = factory.Create(factoryDescriptor)
+	assert.Nil(t, err)
+	queueFactory, ok := comp.(build.IMessageQueueFactory)
+	assert.True(t, ok)
+	assert.Equal(t, "test2", queueFactory.CreateQueue("test2").Name())
+
+	unknownDescriptor := cref.NewDescriptor("pip-services", "message-queue", "kafka", "test", "1.0")
+	assert.Nil(t, factory.CanCreate(unknownDescriptor))
+}
@@ -0,0 +1,43 @@
+package test_queues
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallbackMessageReceiver(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	var lock sync.Mutex
+	messages := []*queues.MessageEnvelope{}
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		messages = append(messages, message)
+		return queue.Complete(message)
+	})
+
+	queue.BeginListen("", receiver)
+	defer queue.EndListen("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 1"))
+	envelope2 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 2"))
+	queue.Send("", envelope1)
+	queue.Send("", envelope2)
+
+	time.Sleep(500 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	assert.Len(t, messages, 2)
+	assert.Equal(t, envelope1.MessageId, messages[0].MessageId)
+	assert.Equal(t, envelope2.MessageId, messages[1].MessageId)
+}
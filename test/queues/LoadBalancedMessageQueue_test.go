@@ -0,0 +1,205 @@
+package test_queues
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBalancedMessageQueueDistribution(t *testing.T) {
+	shard1 := queues.NewMemoryMessageQueue("Shard1")
+	shard2 := queues.NewMemoryMessageQueue("Shard2")
+	queue := queues.NewLoadBalancedMessageQueue("TestQueue", shard1, shard2)
+	assert.Nil(t, queue.Open(""))
+	defer queue.Close("")
+	assert.True(t, shard1.IsOpen())
+	assert.True(t, shard2.IsOpen())
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message"))))
+	}
+
+	count1, _ := shard1.ReadMessageCount()
+	count2, _ := shard2.ReadMessageCount()
+	assert.Equal(t, int64(5), count1)
+	assert.Equal(t, int64(5), count2)
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(10), count)
+
+	for i := 0; i < 10; i++ {
+		message, err := queue.Receive("", 10000*time.Millisecond)
+		assert.Nil(t, err)
+		assert.NotNil(t, message)
+		assert.Nil(t, queue.Complete(message))
+	}
+
+	count, _ = queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+
+	message, err := queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, message)
+}
+
+func TestLoadBalancedMessageQueueAbandon(t *testing.T) {
+	shard1 := queues.NewMemoryMessageQueue("Shard1")
+	shard2 := queues.NewMemoryMessageQueue("Shard2")
+	queue := queues.NewLoadBalancedMessageQueue("TestQueue", shard1, shard2)
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, queue.Abandon(message))
+	count1, _ := shard1.ReadMessageCount()
+	assert.Equal(t, int64(1), count1)
+
+	// Messages that were not received via the queue are rejected
+	err := queue.Complete(queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	assert.True(t, errors.Is(err, queues.ErrMessageNotReceived))
+}
+
+func TestLoadBalancedMessageQueueListen(t *testing.T) {
+	queue := queues.NewLoadBalancedMessageQueue("TestQueue",
+		queues.NewMemoryMessageQueue("Shard1"), queues.NewMemoryMessageQueue("Shard2"))
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"listen.ack_mode", "auto",
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	receiver := queues.NewMockMessageReceiver()
+	queue.BeginListen("", receiver)
+	defer queue.EndListen("")
+
+	for i := 0; i < 4; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	assert.Eventually(t, func() bool { return receiver.Count() == 4 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		count, _ := queue.ReadMessageCount()
+		return count == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLoadBalancedMessageQueueListenLockTimeout(t *testing.T) {
+	queue := queues.NewLoadBalancedMessageQueue("TestQueue",
+		queues.NewMemoryMessageQueue("Shard1"), queues.NewMemoryMessageQueue("Shard2"))
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"receive.poll_interval", 50,
+		"receive.lock_timeout", 5000,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	var deliveries int32
+	var failures int32
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		atomic.AddInt32(&deliveries, 1)
+		// Processing takes longer than the poll interval
+		time.Sleep(200 * time.Millisecond)
+		if err := queue.Complete(message); err != nil {
+			atomic.AddInt32(&failures, 1)
+		}
+		return nil
+	})
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	queue.BeginListen("", receiver)
+
+	assert.Eventually(t, func() bool {
+		count, _ := queue.ReadMessageCount()
+		return count == 0 && atomic.LoadInt32(&deliveries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// EndListen waits until the receiver returns
+	queue.EndListen("")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deliveries))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&failures))
+}
+
+func TestLoadBalancedMessageQueueEndListenWaits(t *testing.T) {
+	queue := queues.NewLoadBalancedMessageQueue("TestQueue", queues.NewMemoryMessageQueue("Shard1"))
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"listen.ack_mode", "auto",
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	var processing int32
+	received := make(chan struct{})
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		atomic.StoreInt32(&processing, 1)
+		close(received)
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&processing, 0)
+		return nil
+	})
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	queue.BeginListen("", receiver)
+
+	<-received
+	queue.EndListen("")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&processing))
+
+	// Auto ack mode completes the processed message
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+	message, _ := queue.Receive("", 0)
+	assert.Nil(t, message)
+}
+
+func TestLoadBalancedMessageQueueExpiredLocks(t *testing.T) {
+	queue := queues.NewLoadBalancedMessageQueue("TestQueue", queues.NewMemoryMessageQueue("Shard1"))
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+
+	expired, _ := queue.Receive("", 50*time.Millisecond)
+	assert.NotNil(t, expired)
+	time.Sleep(100 * time.Millisecond)
+
+	// Owners of messages with expired locks are dropped on the next receive
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.NotNil(t, message)
+	err := queue.Complete(expired)
+	assert.True(t, errors.Is(err, queues.ErrMessageNotReceived))
+	assert.Nil(t, queue.Complete(message))
+}
+
+func TestLoadBalancedMessageQueueBlockedChild(t *testing.T) {
+	shard1 := queues.NewMemoryMessageQueue("Shard1")
+	shard2 := queues.NewMemoryMessageQueue("Shard2")
+	queue := queues.NewLoadBalancedMessageQueue("TestQueue", shard1, shard2)
+	queue.Open("")
+	defer queue.Close("")
+
+	// The first shard has a message held back by its locked group
+	for _, body := range []string{"A0", "A1"} {
+		envelope := queues.NewMessageEnvelope("123", "Test", []byte(body))
+		envelope.GroupId = "A"
+		shard1.Send("", envelope)
+	}
+	locked, _ := shard1.Receive("", 10000*time.Millisecond)
+	assert.NotNil(t, locked)
+
+	shard2.Send("", queues.NewMessageEnvelope("123", "Test", []byte("B0")))
+
+	// Available message in the second shard is received without waiting on the first one
+	start := time.Now()
+	message, err := queue.Receive("", 2000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.NotNil(t, message)
+	assert.Equal(t, "B0", message.GetMessageAsString())
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+}
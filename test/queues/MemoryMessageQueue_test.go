@@ -1,9 +1,25 @@
 package test_queues
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	cconn "github.com/pip-services3-go/pip-services3-components-go/connect"
+	ccount "github.com/pip-services3-go/pip-services3-components-go/count"
+	clog "github.com/pip-services3-go/pip-services3-components-go/log"
 	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMemoryMessageQueue(t *testing.T) {
@@ -21,5 +37,3230 @@ func TestMemoryMessageQueue(t *testing.T) {
 	t.Run("MemoryMessageQueue:Send Peek Message", fixture.TestSendPeekMessage)
 	t.Run("MemoryMessageQueue:Peek No Message", fixture.TestPeekNoMessage)
 	t.Run("MemoryMessageQueue:Move To Dead Message", fixture.TestMoveToDeadMessage)
+	t.Run("MemoryMessageQueue:Receive Fifo Order", fixture.TestReceiveFifoOrder)
 	t.Run("MemoryMessageQueue:On Message", fixture.TestOnMessage)
 }
+
+func TestMemoryMessageQueueListenAfterEmptyPoll(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	receiver := TestMsgReceiver{}
+	queue.BeginListen("", &receiver)
+	defer queue.EndListen("")
+
+	// Let the listener go through at least one empty poll
+	time.Sleep(1500 * time.Millisecond)
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	sndErr := queue.Send("", envelope1)
+	assert.Nil(t, sndErr)
+
+	time.Sleep(500 * time.Millisecond)
+
+	envelope2 := receiver.GetMessage()
+	assert.NotNil(t, envelope2)
+	assert.Equal(t, envelope1.MessageId, envelope2.MessageId)
+}
+
+func TestMemoryMessageQueueReceiveTimeout(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	start := time.Now()
+	envelope, rcvErr := queue.Receive("", 200*time.Millisecond)
+	elapsed := time.Since(start)
+
+	assert.Nil(t, rcvErr)
+	assert.Nil(t, envelope)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(200*time.Millisecond))
+	assert.Less(t, int64(elapsed), int64(1000*time.Millisecond))
+}
+
+func BenchmarkMemoryMessageQueueSendReceive(b *testing.B) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		done := make(chan *queues.MessageEnvelope)
+		go func() {
+			message, _ := queue.Receive("", 10000*time.Millisecond)
+			done <- message
+		}()
+
+		queue.Send("", envelope)
+		message := <-done
+		queue.Complete(message)
+	}
+}
+
+func BenchmarkMemoryMessageQueueReceive(b *testing.B) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		queue.Send("", envelope)
+		b.StartTimer()
+
+		message, _ := queue.Receive("", 10000*time.Millisecond)
+		err := queue.Complete(message)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMemoryMessageQueueReceiveInto(b *testing.B) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	message := &queues.MessageEnvelope{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		queue.Send("", envelope)
+		b.StartTimer()
+
+		ok, _ := queue.ReceiveInto("", message, 10000*time.Millisecond)
+		if !ok {
+			b.Fatal("Message was not received")
+		}
+		err := queue.Complete(message)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMemoryMessageQueueSend(b *testing.B) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queue.Send("", envelope)
+		if i%1000 == 999 {
+			b.StopTimer()
+			queue.Clear("")
+			b.StartTimer()
+		}
+	}
+}
+
+func benchmarkMemoryMessageQueuePeekBatch(b *testing.B,
+	peek func(queue *queues.MemoryMessageQueue) ([]*queues.MessageEnvelope, error)) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	payload := make([]byte, 64*1024)
+	for i := 0; i < 10; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", payload))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		peek(queue)
+	}
+}
+
+func BenchmarkMemoryMessageQueuePeekBatch(b *testing.B) {
+	benchmarkMemoryMessageQueuePeekBatch(b, func(queue *queues.MemoryMessageQueue) ([]*queues.MessageEnvelope, error) {
+		return queue.PeekBatch("", 10)
+	})
+}
+
+func BenchmarkMemoryMessageQueuePeekBatchRefs(b *testing.B) {
+	benchmarkMemoryMessageQueuePeekBatch(b, func(queue *queues.MemoryMessageQueue) ([]*queues.MessageEnvelope, error) {
+		return queue.PeekBatchRefs("", 10)
+	})
+}
+
+func TestMemoryMessageQueueSendBatch(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelopes := make([]*queues.MessageEnvelope, 100)
+	for i := range envelopes {
+		envelopes[i] = queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	}
+
+	sndErr := queue.SendBatch("", envelopes)
+	assert.Nil(t, sndErr)
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(100), count)
+
+	for _, envelope := range envelopes {
+		assert.False(t, envelope.SentTime.IsZero())
+	}
+}
+
+func TestMemoryMessageQueueSendBatchOverflow(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"capacity", 2,
+		"send.blocking", false,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	envelopes := make([]*queues.MessageEnvelope, 3)
+	for i := range envelopes {
+		envelopes[i] = queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	}
+
+	// Messages that fit into the queue are sent
+	err := queue.SendBatch("", envelopes)
+	assert.True(t, errors.Is(err, queues.ErrQueueOverflow))
+
+	var batchErr *queues.BatchError
+	assert.True(t, errors.As(err, &batchErr))
+	assert.Len(t, batchErr.Errors, 3)
+	assert.Nil(t, batchErr.Errors[0])
+	assert.Nil(t, batchErr.Errors[1])
+	assert.NotNil(t, batchErr.Errors[2])
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(2), count)
+}
+
+func TestMemoryMessageQueueExpiredLock(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"lock.reaper_interval", 50,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	sndErr := queue.Send("", envelope1)
+	assert.Nil(t, sndErr)
+
+	// Receive the message and never complete it
+	envelope2, rcvErr := queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope2)
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(0), count)
+
+	time.Sleep(300 * time.Millisecond)
+
+	count, rdErr = queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(1), count)
+
+	envelope3, rcvErr := queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope3)
+	assert.Equal(t, envelope1.MessageId, envelope3.MessageId)
+}
+
+func TestMemoryMessageQueuePeekBatch(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelopes := []*queues.MessageEnvelope{
+		queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")),
+		queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")),
+		queues.NewMessageEnvelope("123", "Test", []byte("Test message 3")),
+	}
+	for _, envelope := range envelopes {
+		sndErr := queue.Send("", envelope)
+		assert.Nil(t, sndErr)
+	}
+
+	peeked, pkErr := queue.PeekBatch("", 10)
+	assert.Nil(t, pkErr)
+	assert.Len(t, peeked, 3)
+	for index, envelope := range envelopes {
+		assert.Equal(t, envelope.MessageId, peeked[index].MessageId)
+	}
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(3), count)
+}
+
+func TestMemoryMessageQueueCapacityBlocking(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"capacity", 1,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	sndErr := queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	assert.Nil(t, sndErr)
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+	}()
+
+	select {
+	case <-sent:
+		assert.Fail(t, "Send shall block while the queue is full")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	envelope, rcvErr := queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope)
+
+	select {
+	case sndErr = <-sent:
+		assert.Nil(t, sndErr)
+	case <-time.After(1000 * time.Millisecond):
+		assert.Fail(t, "Send shall unblock when space becomes available")
+	}
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryMessageQueueCapacityBlockingClose(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"capacity", 1,
+	))
+	queue.Open("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	queue.Close("")
+
+	select {
+	case sndErr := <-sent:
+		assert.True(t, errors.Is(sndErr, queues.ErrQueueClosed))
+	case <-time.After(1000 * time.Millisecond):
+		assert.Fail(t, "Send shall unblock when the queue is closed")
+	}
+}
+
+func TestMemoryMessageQueueCapacityOverflow(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"capacity", 2,
+		"send.blocking", false,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	sndErr := queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	assert.Nil(t, sndErr)
+	sndErr = queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+	assert.Nil(t, sndErr)
+
+	sndErr = queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 3")))
+	assert.True(t, errors.Is(sndErr, queues.ErrQueueOverflow))
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestMemoryMessageQueuePriority(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	normal1 := queues.NewMessageEnvelope("123", "Test", []byte("Normal message 1"))
+	normal2 := queues.NewMessageEnvelope("123", "Test", []byte("Normal message 2"))
+	high1 := queues.NewMessageEnvelope("123", "Test", []byte("High message 1"))
+	high1.Priority = 10
+	high2 := queues.NewMessageEnvelope("123", "Test", []byte("High message 2"))
+	high2.Priority = 10
+	low := queues.NewMessageEnvelope("123", "Test", []byte("Low message"))
+	low.Priority = -1
+
+	for _, envelope := range []*queues.MessageEnvelope{normal1, low, high1, normal2, high2} {
+		sndErr := queue.Send("", envelope)
+		assert.Nil(t, sndErr)
+	}
+
+	peeked, pkErr := queue.Peek("")
+	assert.Nil(t, pkErr)
+	assert.NotNil(t, peeked)
+	assert.Equal(t, high1.MessageId, peeked.MessageId)
+
+	for _, envelope := range []*queues.MessageEnvelope{high1, high2, normal1, normal2, low} {
+		received, rcvErr := queue.Receive("", 100*time.Millisecond)
+		assert.Nil(t, rcvErr)
+		assert.NotNil(t, received)
+		assert.Equal(t, envelope.MessageId, received.MessageId)
+	}
+}
+
+func TestMemoryMessageQueueSendDelayed(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	sndErr := queue.SendDelayed("", envelope1, 200*time.Millisecond)
+	assert.Nil(t, sndErr)
+
+	envelope2, rcvErr := queue.Receive("", 0)
+	assert.Nil(t, rcvErr)
+	assert.Nil(t, envelope2)
+
+	envelope2, pkErr := queue.Peek("")
+	assert.Nil(t, pkErr)
+	assert.Nil(t, envelope2)
+
+	envelope2, rcvErr = queue.Receive("", 1000*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope2)
+	assert.Equal(t, envelope1.MessageId, envelope2.MessageId)
+	assert.GreaterOrEqual(t, int64(time.Since(envelope1.SentTime)), int64(200*time.Millisecond))
+}
+
+func TestMemoryMessageQueueDeadLetter(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	sndErr := queue.Send("", envelope1)
+	assert.Nil(t, sndErr)
+
+	envelope2, rcvErr := queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope2)
+
+	mvErr := queue.MoveToDeadLetter(envelope2)
+	assert.Nil(t, mvErr)
+
+	count, rdErr := queue.ReadDeadLetterCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(1), count)
+
+	deadLetters, pkErr := queue.PeekDeadLetter("")
+	assert.Nil(t, pkErr)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, envelope1.MessageId, deadLetters[0].MessageId)
+	assert.Equal(t, envelope1.Message, deadLetters[0].Message)
+
+	rqErr := queue.RequeueFromDeadLetter("", "unknown")
+	assert.True(t, errors.Is(rqErr, queues.ErrMessageNotFound))
+
+	rqErr = queue.RequeueFromDeadLetter("", envelope1.MessageId)
+	assert.Nil(t, rqErr)
+
+	count, rdErr = queue.ReadDeadLetterCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(0), count)
+
+	envelope3, rcvErr := queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope3)
+	assert.Equal(t, envelope1.MessageId, envelope3.MessageId)
+}
+
+func TestMemoryMessageQueueMaxDeliveryCount(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"max_delivery_count", 3,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	sndErr := queue.Send("", envelope1)
+	assert.Nil(t, sndErr)
+
+	for deliveryCount := 1; deliveryCount <= 3; deliveryCount++ {
+		envelope2, rcvErr := queue.Receive("", 100*time.Millisecond)
+		assert.Nil(t, rcvErr)
+		assert.NotNil(t, envelope2)
+		assert.Equal(t, deliveryCount, envelope2.DeliveryCount)
+
+		abdErr := queue.Abandon(envelope2)
+		assert.Nil(t, abdErr)
+	}
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(0), count)
+
+	deadLetters, pkErr := queue.PeekDeadLetter("")
+	assert.Nil(t, pkErr)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, envelope1.MessageId, deadLetters[0].MessageId)
+	assert.Equal(t, 3, deadLetters[0].DeliveryCount)
+}
+
+func TestMemoryMessageQueueEndListen(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	var received int32
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		atomic.AddInt32(&received, 1)
+		return queue.Complete(message)
+	})
+
+	stopped := make(chan bool, 1)
+	go func() {
+		queue.Listen("", receiver)
+		stopped <- true
+	}()
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+
+	queue.EndListen("")
+
+	select {
+	case <-stopped:
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "Listen shall be stopped when EndListen returns")
+	}
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
+
+func TestMemoryMessageQueueListenWithWorkers(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	var received int32
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		time.Sleep(300 * time.Millisecond)
+		atomic.AddInt32(&received, 1)
+		return queue.Complete(message)
+	})
+
+	go queue.ListenWithWorkers("", receiver, 4)
+	defer queue.EndListen("")
+
+	for i := 0; i < 4; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	// Serial processing would take 1200ms
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&received))
+}
+
+func TestMemoryMessageQueueLockErrors(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"lock.reaper_interval", 0,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	// Complete already completed message
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	envelope, rcvErr := queue.Receive("", 1000*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope)
+
+	reference := envelope.GetReference()
+	cplErr := queue.Complete(envelope)
+	assert.Nil(t, cplErr)
+
+	envelope.SetReference(reference)
+	cplErr = queue.Complete(envelope)
+	assert.True(t, errors.Is(cplErr, queues.ErrMessageNotLocked))
+
+	// Renew expired lock
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	envelope, rcvErr = queue.Receive("", 50*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope)
+
+	time.Sleep(100 * time.Millisecond)
+
+	rnwErr := queue.RenewLock(envelope, 1000*time.Millisecond)
+	assert.True(t, errors.Is(rnwErr, queues.ErrLockExpired))
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryMessageQueueCloseGraceful(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+
+	var completed int32
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		time.Sleep(300 * time.Millisecond)
+		atomic.AddInt32(&completed, 1)
+		return queue.Complete(message)
+	})
+	queue.BeginListen("", receiver)
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+	time.Sleep(100 * time.Millisecond)
+
+	clsErr := queue.CloseGraceful("", 1000*time.Millisecond)
+	assert.Nil(t, clsErr)
+	assert.False(t, queue.IsOpen())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&completed))
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryMessageQueueCloseGracefulTimeout(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	envelope, rcvErr := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope)
+
+	clsErr := queue.CloseGraceful("", 100*time.Millisecond)
+	assert.True(t, errors.Is(clsErr, queues.ErrCloseTimeout))
+	assert.Contains(t, clsErr.Error(), "1 messages")
+	assert.False(t, queue.IsOpen())
+}
+
+func TestMemoryMessageQueueGetStats(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 0; i < 4; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	envelope1, _ := queue.Receive("", 100*time.Millisecond)
+	queue.Complete(envelope1)
+	envelope2, _ := queue.Receive("", 100*time.Millisecond)
+	queue.MoveToDeadLetter(envelope2)
+	queue.Receive("", 10000*time.Millisecond)
+
+	stats := queue.GetStats()
+	assert.Equal(t, int64(1), stats.PendingCount)
+	assert.Equal(t, int64(1), stats.LockedCount)
+	assert.Equal(t, int64(1), stats.DeadCount)
+	assert.Equal(t, int64(4), stats.TotalSent)
+	assert.Equal(t, int64(3), stats.TotalReceived)
+	assert.Equal(t, int64(1), stats.TotalDead)
+
+	buffer, err := json.Marshal(stats)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buffer), "\"pending_count\":1")
+}
+
+func TestMemoryMessageQueueDeduplication(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"dedup.enabled", true,
+		"dedup.ttl", 200,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	sndErr := queue.Send("", envelope)
+	assert.Nil(t, sndErr)
+
+	// Duplicate within the window is dropped
+	sndErr = queue.Send("", envelope)
+	assert.Nil(t, sndErr)
+
+	count, rdErr := queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(1), count)
+
+	// Duplicate outside the window is accepted
+	time.Sleep(300 * time.Millisecond)
+
+	sndErr = queue.Send("", envelope)
+	assert.Nil(t, sndErr)
+
+	count, rdErr = queue.ReadMessageCount()
+	assert.Nil(t, rdErr)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestMemoryMessageQueueDeduplicationBlocking(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"capacity", 1,
+		"dedup.enabled", true,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+
+	// Both senders wait for space with the same message
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message 2"))
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, queue.Send("", envelope.Clone()))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		message, _ := queue.Receive("", 1000*time.Millisecond)
+		assert.NotNil(t, message)
+		queue.Complete(message)
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+}
+
+func TestMemoryMessageQueueExpiredMessages(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"expired.dead_letter", true,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Expiring message"))
+	envelope1.ExpiresAt = time.Now().Add(100 * time.Millisecond)
+	queue.Send("", envelope1)
+	envelope2 := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	queue.Send("", envelope2)
+
+	peeked, pkErr := queue.Peek("")
+	assert.Nil(t, pkErr)
+	assert.Equal(t, envelope1.MessageId, peeked.MessageId)
+
+	time.Sleep(200 * time.Millisecond)
+
+	peeked, pkErr = queue.Peek("")
+	assert.Nil(t, pkErr)
+	assert.Equal(t, envelope2.MessageId, peeked.MessageId)
+
+	// Peek discards expired messages
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+
+	received, rcvErr := queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.Equal(t, envelope2.MessageId, received.MessageId)
+
+	received, rcvErr = queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.Nil(t, received)
+
+	deadLetters, dlErr := queue.PeekDeadLetter("")
+	assert.Nil(t, dlErr)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, envelope1.MessageId, deadLetters[0].MessageId)
+}
+
+func TestMemoryMessageQueueListenWithFilter(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	receiverA := &messageCollector{}
+	receiverB := &messageCollector{}
+
+	go queue.ListenWithFilter("", receiverA, func(message *queues.MessageEnvelope) bool {
+		return message.MessageType == "TypeA"
+	})
+	go queue.ListenWithFilter("", receiverB, func(message *queues.MessageEnvelope) bool {
+		return message.MessageType == "TypeB"
+	})
+	defer queue.EndListen("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "TypeA", []byte("Message A1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "TypeB", []byte("Message B1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "TypeA", []byte("Message A2")))
+	queue.Send("", queues.NewMessageEnvelope("123", "TypeC", []byte("Message C1")))
+
+	time.Sleep(200 * time.Millisecond)
+
+	messagesA := receiverA.GetMessages()
+	messagesB := receiverB.GetMessages()
+	assert.Len(t, messagesA, 2)
+	assert.Len(t, messagesB, 1)
+	for _, message := range messagesA {
+		assert.Equal(t, "TypeA", message.MessageType)
+	}
+	assert.Equal(t, "TypeB", messagesB[0].MessageType)
+
+	// Not matching message stays in the queue
+	count, err := queue.ReadMessageCount()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryMessageQueueSendAsObject(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	type testObject struct {
+		Name  string `json:"name"`
+		Value int    `json:"value"`
+	}
+
+	err := queue.SendAsObject("123", "Test", testObject{Name: "ABC", Value: 123})
+	assert.Nil(t, err)
+
+	envelope, rcvErr := queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, rcvErr)
+	assert.NotNil(t, envelope)
+	assert.Equal(t, "123", envelope.CorrelationId)
+	assert.Equal(t, "Test", envelope.MessageType)
+
+	value, ok := envelope.GetMessageAsJson().(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "ABC", value["name"])
+	assert.Equal(t, float64(123), value["value"])
+
+	// Values that cannot be converted to JSON are not sent
+	err = queue.SendAsObject("123", "Test", make(chan int))
+	assert.NotNil(t, err)
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+}
+
+func TestMemoryMessageQueueSaveToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 1"))
+	envelope2 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 2"))
+	envelope3 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 3"))
+	queue.Send("", envelope1)
+	queue.Send("", envelope2)
+	queue.Send("", envelope3)
+
+	// Lock the first message and move the second one into dead letters
+	locked, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, envelope1.MessageId, locked.MessageId)
+	dead, _ := queue.Receive("", 10000*time.Millisecond)
+	queue.MoveToDeadLetter(dead)
+
+	err := queue.SaveToFile(path)
+	assert.Nil(t, err)
+
+	restored := queues.NewMemoryMessageQueue("TestQueue")
+	restored.Open("")
+	defer restored.Close("")
+
+	err = restored.LoadFromFile(path)
+	assert.Nil(t, err)
+
+	count, _ := restored.ReadMessageCount()
+	assert.Equal(t, int64(2), count)
+	deadCount, _ := restored.ReadDeadLetterCount()
+	assert.Equal(t, int64(1), deadCount)
+
+	// Locked message is returned back to the queue
+	received, _ := restored.Receive("", 100*time.Millisecond)
+	assert.NotNil(t, received)
+	assert.Equal(t, envelope1.MessageId, received.MessageId)
+	assert.Equal(t, "Test message 1", received.GetMessageAsString())
+	assert.Equal(t, 2, received.DeliveryCount)
+
+	received, _ = restored.Receive("", 100*time.Millisecond)
+	assert.NotNil(t, received)
+	assert.Equal(t, envelope3.MessageId, received.MessageId)
+
+	deadLetters, _ := restored.PeekDeadLetter("")
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, envelope2.MessageId, deadLetters[0].MessageId)
+
+	err = restored.LoadFromFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestMemoryMessageQueueLoadFromFileResetsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"dedup.enabled", true,
+		"retain.max_count", 10,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	err := queue.SaveToFile(path)
+	assert.Nil(t, err)
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	queue.Send("", envelope)
+	received, _ := queue.Receive("", 100*time.Millisecond)
+	queue.Complete(received)
+
+	err = queue.LoadFromFile(path)
+	assert.Nil(t, err)
+
+	// Completed messages are no longer retained
+	err = queue.Rewind("")
+	assert.Nil(t, err)
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+
+	// Message ids sent before loading are forgotten
+	queue.Send("", envelope)
+	count, _ = queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+
+	queue.Close("")
+	err = queue.LoadFromFile(path)
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+}
+
+func TestMemoryMessageQueueReceiveBatch(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 0; i < 5; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	// Full batch
+	messages, err := queue.ReceiveBatch("", 3, 10000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 3)
+	assert.True(t, messages[0].GetReference() != messages[1].GetReference())
+
+	// Partial batch
+	rest, err := queue.ReceiveBatch("", 3, 10000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Len(t, rest, 2)
+
+	// Empty queue
+	empty, err := queue.ReceiveBatch("", 3, 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Len(t, empty, 0)
+
+	// Received messages are completed and abandoned individually
+	assert.Nil(t, queue.Complete(messages[0]))
+	assert.Nil(t, queue.Complete(messages[1]))
+	assert.Nil(t, queue.Abandon(messages[2]))
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+	stats := queue.GetStats()
+	assert.Equal(t, int64(2), stats.LockedCount)
+}
+
+func TestMemoryMessageQueueGetLockToken(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	queue.Send("", envelope)
+
+	_, ok := queue.GetLockToken(envelope)
+	assert.False(t, ok)
+
+	received, _ := queue.Receive("", 10000*time.Millisecond)
+	token, ok := queue.GetLockToken(received)
+	assert.True(t, ok)
+
+	// Complete the message using a new envelope that carries the stored token
+	checkpoint := queues.NewEmptyMessageEnvelope()
+	checkpoint.SetReference(token)
+	err := queue.Complete(checkpoint)
+	assert.Nil(t, err)
+
+	_, ok = queue.GetLockToken(received)
+	assert.False(t, ok)
+	stats := queue.GetStats()
+	assert.Equal(t, int64(0), stats.LockedCount)
+	assert.Equal(t, int64(0), stats.PendingCount)
+}
+
+func TestMemoryMessageQueueConfigure(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"name", "ConfiguredQueue",
+		"capacity", 1,
+		"send.blocking", false,
+		"receive.poll_interval", 50,
+		"lock.reaper_interval", 50,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	assert.Equal(t, "ConfiguredQueue", queue.Name())
+
+	// Capacity is applied
+	err := queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	assert.Nil(t, err)
+	err = queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+	assert.True(t, errors.Is(err, queues.ErrQueueOverflow))
+
+	// Expired locks are returned by the reaper
+	received, _ := queue.Receive("", 10*time.Millisecond)
+	assert.NotNil(t, received)
+	time.Sleep(150 * time.Millisecond)
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+
+	// Listener polls with the configured interval
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		return nil
+	})
+	go queue.ListenWithFilter("", receiver, func(message *queues.MessageEnvelope) bool {
+		return false
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	queue.EndListen("")
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+}
+
+func TestMemoryMessageQueueCompleteBatch(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 0; i < 3; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	messages, _ := queue.ReceiveBatch("", 3, 10000*time.Millisecond)
+	assert.Len(t, messages, 3)
+
+	// Message with invalid reference fails but others are completed
+	invalid := queues.NewMessageEnvelope("123", "Test", []byte("Invalid message"))
+	batch := []*queues.MessageEnvelope{messages[0], invalid, messages[1], messages[2]}
+
+	err := queue.CompleteBatch(batch)
+	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, queues.ErrMessageNotLocked))
+
+	var batchErr *queues.BatchError
+	assert.True(t, errors.As(err, &batchErr))
+	assert.Len(t, batchErr.Errors, 4)
+	assert.Nil(t, batchErr.Errors[0])
+	assert.NotNil(t, batchErr.Errors[1])
+	assert.Nil(t, batchErr.Errors[2])
+	assert.Nil(t, batchErr.Errors[3])
+
+	stats := queue.GetStats()
+	assert.Equal(t, int64(0), stats.LockedCount)
+	assert.Equal(t, int64(0), stats.PendingCount)
+}
+
+func TestMemoryMessageQueueAbandonBatch(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 0; i < 2; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	messages, _ := queue.ReceiveBatch("", 2, 10000*time.Millisecond)
+	assert.Len(t, messages, 2)
+
+	err := queue.AbandonBatch(messages)
+	assert.Nil(t, err)
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(2), count)
+
+	// Abandoned messages cannot be abandoned again
+	err = queue.AbandonBatch(messages)
+	assert.True(t, errors.Is(err, queues.ErrMessageNotLocked))
+}
+
+func TestMemoryMessageQueueName(t *testing.T) {
+	queue, err := queues.NewMemoryMessageQueueWithError("Test_Queue-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Test_Queue-1", queue.Name())
+
+	_, err = queues.NewMemoryMessageQueueWithError("")
+	assert.True(t, errors.Is(err, queues.ErrInvalidQueueName))
+
+	_, err = queues.NewMemoryMessageQueueWithError("test.queue")
+	assert.True(t, errors.Is(err, queues.ErrInvalidQueueName))
+
+	_, err = queues.NewMemoryMessageQueueWithError("test queue")
+	assert.True(t, errors.Is(err, queues.ErrInvalidQueueName))
+
+	// Empty name gets a unique default
+	queue1 := queues.NewMemoryMessageQueue("")
+	queue2 := queues.NewMemoryMessageQueue("")
+	assert.NotEqual(t, "", queue1.Name())
+	assert.NotEqual(t, queue1.Name(), queue2.Name())
+}
+
+type xorCipher struct {
+	key byte
+}
+
+func (c *xorCipher) Encrypt(data []byte) ([]byte, error) {
+	result := make([]byte, len(data))
+	for index := range data {
+		result[index] = data[index] ^ c.key
+	}
+	return result, nil
+}
+
+func (c *xorCipher) Decrypt(data []byte) ([]byte, error) {
+	return c.Encrypt(data)
+}
+
+func TestMemoryMessageQueueCipher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	// Legacy message sent before the cipher is set
+	legacy := queues.NewMessageEnvelope("123", "Test", []byte("Legacy message"))
+	queue.Send("", legacy)
+
+	queue.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("test", "cipher", "xor", "default", "1.0"), &xorCipher{key: 0x5A},
+	))
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Secret message"))
+	err := queue.Send("", envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, "Secret message", envelope.GetMessageAsString())
+
+	// Messages are stored encrypted
+	err = queue.SaveToFile(path)
+	assert.Nil(t, err)
+	data, _ := os.ReadFile(path)
+	assert.Contains(t, string(data), "Legacy message")
+	assert.NotContains(t, string(data), "Secret message")
+	assert.Contains(t, string(data), "Content-Encryption")
+
+	// Peek and Receive decrypt messages transparently
+	peeked, _ := queue.PeekBatch("", 2)
+	assert.Len(t, peeked, 2)
+	assert.Equal(t, "Legacy message", peeked[0].GetMessageAsString())
+	assert.Equal(t, "Secret message", peeked[1].GetMessageAsString())
+
+	received, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Legacy message", received.GetMessageAsString())
+	queue.Complete(received)
+
+	received, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Secret message", received.GetMessageAsString())
+	_, ok := received.GetHeader("Content-Encryption")
+	assert.False(t, ok)
+
+	// Abandoned message is stored encrypted again
+	err = queue.Abandon(received)
+	assert.Nil(t, err)
+	queue.SaveToFile(path)
+	data, _ = os.ReadFile(path)
+	assert.NotContains(t, string(data), "Secret message")
+
+	peekedMessage, _ := queue.Peek("")
+	assert.Equal(t, "Secret message", peekedMessage.GetMessageAsString())
+}
+
+type captureLogger struct {
+	*clog.Logger
+	lock           sync.Mutex
+	correlationIds []string
+}
+
+func newCaptureLogger() *captureLogger {
+	c := &captureLogger{}
+	c.Logger = clog.InheritLogger(c)
+	return c
+}
+
+func (c *captureLogger) Write(level int, correlationId string, err error, message string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if level == clog.Error {
+		c.correlationIds = append(c.correlationIds, correlationId)
+	}
+}
+
+func (c *captureLogger) GetCorrelationIds() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.correlationIds...)
+}
+
+func TestMemoryMessageQueueListenLogsMessageCorrelationId(t *testing.T) {
+	logger := newCaptureLogger()
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("test", "logger", "capture", "default", "1.0"), logger,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		queue.Complete(message)
+		if message.MessageType == "Panic" {
+			panic("Test panic")
+		}
+		return errors.New("Test error")
+	})
+	go queue.Listen("listener", receiver)
+	defer queue.EndListen("")
+
+	queue.Send("", queues.NewMessageEnvelope("message-1", "Test", []byte("Test message")))
+	queue.Send("", queues.NewMessageEnvelope("message-2", "Panic", []byte("Test message")))
+	queue.Send("", queues.NewMessageEnvelope("", "Test", []byte("Test message")))
+
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equal(t, []string{"message-1", "message-2", "listener"}, logger.GetCorrelationIds())
+}
+
+func TestMemoryMessageQueueAbandonWithDelay(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	queue.Send("", envelope)
+
+	received, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.NotNil(t, received)
+
+	err := queue.AbandonWithDelay(received, 200*time.Millisecond)
+	assert.Nil(t, err)
+
+	// Message is not visible until the delay elapses
+	received, _ = queue.Receive("", 100*time.Millisecond)
+	assert.Nil(t, received)
+
+	start := time.Now()
+	received, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.NotNil(t, received)
+	assert.Equal(t, envelope.MessageId, received.MessageId)
+	assert.Equal(t, 2, received.DeliveryCount)
+	assert.True(t, time.Since(start) < 1000*time.Millisecond)
+}
+
+func TestMemoryMessageQueueMaxMessageSize(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"max_message_size", 10,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	// Under the limit
+	err := queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("123456789")))
+	assert.Nil(t, err)
+
+	// At the limit
+	err = queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("1234567890")))
+	assert.Nil(t, err)
+
+	// Over the limit
+	err = queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("12345678901")))
+	assert.True(t, errors.Is(err, queues.ErrMessageTooLarge))
+	assert.Contains(t, err.Error(), "11 bytes")
+	assert.Contains(t, err.Error(), "10 bytes")
+
+	err = queue.SendBatch("", []*queues.MessageEnvelope{
+		queues.NewMessageEnvelope("123", "Test", []byte("123")),
+		queues.NewMessageEnvelope("123", "Test", []byte("12345678901")),
+	})
+	assert.True(t, errors.Is(err, queues.ErrMessageTooLarge))
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(2), count)
+}
+
+func TestMemoryMessageQueueDrain(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelopes := []*queues.MessageEnvelope{}
+	for i := 0; i < 6; i++ {
+		envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+		envelopes = append(envelopes, envelope)
+		queue.Send("", envelope)
+	}
+
+	// Locked message is not drained
+	locked, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, envelopes[0].MessageId, locked.MessageId)
+
+	messages, err := queue.Drain("")
+	assert.Nil(t, err)
+	assert.Len(t, messages, 5)
+	for index := range messages {
+		assert.Equal(t, envelopes[index+1].MessageId, messages[index].MessageId)
+	}
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+	stats := queue.GetStats()
+	assert.Equal(t, int64(1), stats.LockedCount)
+}
+
+func TestMemoryMessageQueueReceiveUnblocksOnClose(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		queue.Close("")
+	})
+
+	start := time.Now()
+	received, err := queue.Receive("", 5000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, received)
+	assert.True(t, time.Since(start) < 1000*time.Millisecond)
+}
+
+func TestMemoryMessageQueueOpenWithParams(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+
+	err := queue.OpenWithParams("", []*cconn.ConnectionParams{
+		cconn.NewConnectionParamsFromTuples("protocol", "memory"),
+	}, nil)
+	assert.Nil(t, err)
+	assert.True(t, queue.IsOpen())
+
+	// Double open
+	err = queue.Open("")
+	assert.NotNil(t, err)
+	assert.Equal(t, "ALREADY_OPENED", err.(*cerr.ApplicationError).Code)
+
+	// Reopen after close
+	queue.Close("")
+	err = queue.Open("")
+	assert.Nil(t, err)
+	queue.Close("")
+
+	// Unsupported protocol
+	err = queue.OpenWithParams("", []*cconn.ConnectionParams{
+		cconn.NewConnectionParamsFromTuples("protocol", "amqp"),
+	}, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, "UNSUPPORTED_PROTOCOL", err.(*cerr.ApplicationError).Code)
+	assert.False(t, queue.IsOpen())
+}
+
+type mockCounters struct {
+	lock   sync.Mutex
+	stats  map[string][]float32
+	counts map[string]int64
+}
+
+func newMockCounters() *mockCounters {
+	return &mockCounters{stats: map[string][]float32{}, counts: map[string]int64{}}
+}
+
+func (c *mockCounters) BeginTiming(name string) *ccount.Timing {
+	return ccount.NewEmptyTiming()
+}
+
+func (c *mockCounters) Stats(name string, value float32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats[name] = append(c.stats[name], value)
+}
+
+func (c *mockCounters) Last(name string, value float32)        {}
+func (c *mockCounters) TimestampNow(name string)               {}
+func (c *mockCounters) Timestamp(name string, value time.Time) {}
+
+func (c *mockCounters) IncrementOne(name string) {
+	c.Increment(name, 1)
+}
+
+func (c *mockCounters) Increment(name string, value int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[name] += int64(value)
+}
+
+func (c *mockCounters) GetCount(name string) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.counts[name]
+}
+
+func (c *mockCounters) GetStats(name string) []float32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]float32{}, c.stats[name]...)
+}
+
+func TestMemoryMessageQueueLatencyStats(t *testing.T) {
+	counters := newMockCounters()
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("test", "counters", "mock", "default", "1.0"), counters,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	time.Sleep(50 * time.Millisecond)
+
+	received, _ := queue.Receive("", 100*time.Millisecond)
+	assert.NotNil(t, received)
+
+	stats := counters.GetStats("queue.TestQueue.message_latency")
+	assert.Len(t, stats, 1)
+	assert.True(t, stats[0] >= 50)
+}
+
+func TestMemoryMessageQueuePeekBy(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelopes := []*queues.MessageEnvelope{}
+	for i := 0; i < 5; i++ {
+		envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+		envelopes = append(envelopes, envelope)
+		queue.Send("", envelope)
+	}
+
+	messageId := envelopes[3].MessageId
+	peeked, err := queue.PeekBy("", func(message *queues.MessageEnvelope) bool {
+		return message.MessageId == messageId
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, peeked)
+	assert.Equal(t, messageId, peeked.MessageId)
+
+	peeked, err = queue.PeekBy("", func(message *queues.MessageEnvelope) bool {
+		return message.MessageId == "unknown"
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, peeked)
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(5), count)
+}
+
+func TestMemoryMessageQueueListenRecoversFromPanic(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	var calls int32
+	collector := &messageCollector{}
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			panic("Test panic")
+		}
+		return collector.ReceiveMessage(message, queue)
+	})
+	go queue.Listen("", receiver)
+	defer queue.EndListen("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 1"))
+	envelope2 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 2"))
+	queue.Send("", envelope1)
+	queue.Send("", envelope2)
+
+	time.Sleep(200 * time.Millisecond)
+
+	messages := collector.GetMessages()
+	assert.Len(t, messages, 2)
+	messageIds := []string{}
+	for _, message := range messages {
+		messageIds = append(messageIds, message.MessageId)
+	}
+	assert.ElementsMatch(t, []string{envelope1.MessageId, envelope2.MessageId}, messageIds)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestMemoryMessageQueueContainsMessageId(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+
+	contains, err := queue.ContainsMessageId(envelope.MessageId)
+	assert.Nil(t, err)
+	assert.False(t, contains)
+
+	queue.Send("", envelope)
+	contains, _ = queue.ContainsMessageId(envelope.MessageId)
+	assert.True(t, contains)
+
+	// Locked messages are still in the queue
+	received, _ := queue.Receive("", 10000*time.Millisecond)
+	contains, _ = queue.ContainsMessageId(envelope.MessageId)
+	assert.True(t, contains)
+
+	queue.Complete(received)
+	contains, _ = queue.ContainsMessageId(envelope.MessageId)
+	assert.False(t, contains)
+}
+
+func TestMemoryMessageQueueNotOpened(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+
+	err := queue.Send("", envelope)
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+
+	err = queue.SendBatch("", []*queues.MessageEnvelope{envelope})
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+
+	_, err = queue.Peek("")
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+
+	_, err = queue.PeekBatch("", 10)
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+
+	start := time.Now()
+	_, err = queue.Receive("", 1000*time.Millisecond)
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	_, err = queue.ReceiveBatch("", 10, 1000*time.Millisecond)
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+
+	// Closed queue behaves the same way
+	queue.Open("")
+	err = queue.Send("", envelope)
+	assert.Nil(t, err)
+	queue.Close("")
+
+	_, err = queue.Receive("", 1000*time.Millisecond)
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+}
+
+func TestMemoryMessageQueueClock(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var clockLock sync.Mutex
+	clock := func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.SetClock(clock)
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	queue.Send("", envelope)
+	assert.Equal(t, now, envelope.SentTime)
+
+	received, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.NotNil(t, received)
+
+	// Move the clock past the lock timeout
+	clockLock.Lock()
+	now = now.Add(11 * time.Second)
+	clockLock.Unlock()
+
+	err := queue.Complete(received)
+	assert.True(t, errors.Is(err, queues.ErrLockExpired))
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryMessageQueuePreserveOrderOnAbandon(t *testing.T) {
+	receiveAfterAbandon := func(preserveOrder bool) []string {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Configure(cconf.NewConfigParamsFromTuples(
+			"abandon.preserve_order", preserveOrder,
+		))
+		queue.Open("")
+		defer queue.Close("")
+
+		for _, text := range []string{"1", "2", "3"} {
+			queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte(text)))
+		}
+
+		received, _ := queue.Receive("", 10000*time.Millisecond)
+		queue.Abandon(received)
+
+		result := []string{}
+		for i := 0; i < 3; i++ {
+			received, _ = queue.Receive("", 10000*time.Millisecond)
+			result = append(result, received.GetMessageAsString())
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"2", "3", "1"}, receiveAfterAbandon(false))
+	assert.Equal(t, []string{"1", "2", "3"}, receiveAfterAbandon(true))
+}
+
+func TestMemoryMessageQueueMessagesChannel(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"receive.poll_interval", 100,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 1; i <= 3; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	messages, cancel := queue.Messages("")
+
+	received := 0
+	for message := range messages {
+		assert.Nil(t, queue.Complete(message))
+		received++
+		if received == 3 {
+			cancel()
+		}
+	}
+	assert.Equal(t, 3, received)
+
+	// Cancel can be called again
+	cancel()
+
+	stats := queue.GetStats()
+	assert.Equal(t, int64(0), stats.PendingCount)
+	assert.Equal(t, int64(0), stats.LockedCount)
+}
+
+func TestMemoryMessageQueueRequeueAllFromDeadLetter(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 0; i < 3; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+	for i := 0; i < 3; i++ {
+		received, _ := queue.Receive("", 10000*time.Millisecond)
+		queue.MoveToDeadLetter(received)
+	}
+
+	deadCount, _ := queue.ReadDeadLetterCount()
+	assert.Equal(t, int64(3), deadCount)
+
+	// Receiver waiting concurrently gets a replayed message
+	receivedChan := make(chan *queues.MessageEnvelope, 1)
+	go func() {
+		received, _ := queue.Receive("", 1000*time.Millisecond)
+		receivedChan <- received
+	}()
+
+	count, err := queue.RequeueAllFromDeadLetter("")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	received := <-receivedChan
+	assert.NotNil(t, received)
+
+	deadCount, _ = queue.ReadDeadLetterCount()
+	assert.Equal(t, int64(0), deadCount)
+	messageCount, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(2), messageCount)
+
+	count, err = queue.RequeueAllFromDeadLetter("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestMemoryMessageQueueRequeueFromDeadLetterResets(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"capacity", 1,
+		"send.blocking", false,
+	))
+	queue.Open("")
+
+	for i := 0; i < 2; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		received, _ := queue.Receive("", 10000*time.Millisecond)
+		queue.MoveToDeadLetterWithReason(received, "Test reason")
+	}
+	deadLetters, _ := queue.PeekDeadLetter("")
+
+	// Requeued message starts over
+	err := queue.RequeueFromDeadLetter("", deadLetters[0].MessageId)
+	reason, _ := deadLetters[0].GetHeader(queues.DeadLetterReasonHeader)
+	assert.Equal(t, "Test reason", reason)
+	assert.Nil(t, err)
+	message, _ := queue.TryReceive("")
+	assert.NotNil(t, message)
+	assert.Equal(t, 1, message.DeliveryCount)
+	_, ok := message.GetHeader(queues.DeadLetterReasonHeader)
+	assert.False(t, ok)
+
+	// Capacity is checked as for sent messages
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	err = queue.RequeueFromDeadLetter("", deadLetters[1].MessageId)
+	assert.True(t, errors.Is(err, queues.ErrQueueOverflow))
+	count, err := queue.RequeueAllFromDeadLetter("")
+	assert.True(t, errors.Is(err, queues.ErrQueueOverflow))
+	assert.Equal(t, 0, count)
+	deadCount, _ := queue.ReadDeadLetterCount()
+	assert.Equal(t, int64(1), deadCount)
+
+	// Closed queue rejects requeues
+	queue.Close("")
+	err = queue.RequeueFromDeadLetter("", deadLetters[1].MessageId)
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+	_, err = queue.RequeueAllFromDeadLetter("")
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+}
+
+func TestMemoryMessageQueueReceiveWithoutWait(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 0; i < 3; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	// Messages received without waiting still get a lock
+	message, err := queue.Receive("", 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, message)
+	assert.Nil(t, queue.Complete(message))
+
+	messages, err := queue.ReceiveBatch("", 2, 0)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 2)
+	assert.Nil(t, queue.Abandon(messages[0]))
+	assert.Nil(t, queue.Complete(messages[1]))
+}
+
+func TestMemoryMessageQueueTryReceive(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	// Empty queue returns immediately
+	start := time.Now()
+	message, err := queue.TryReceive("")
+	assert.Nil(t, err)
+	assert.Nil(t, message)
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+
+	message, err = queue.TryReceive("")
+	assert.Nil(t, err)
+	assert.NotNil(t, message)
+	assert.Equal(t, "Test message", message.GetMessageAsString())
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+	assert.Nil(t, queue.Complete(message))
+}
+
+type recordingEventListener struct {
+	lock   sync.Mutex
+	events []queues.QueueEvent
+}
+
+func (c *recordingEventListener) OnQueueEvent(event queues.QueueEvent, message *queues.MessageEnvelope) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.events = append(c.events, event)
+}
+
+func TestMemoryMessageQueueEventListener(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	listener := &recordingEventListener{}
+	queue.AddEventListener(listener)
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, queue.Abandon(message))
+	message, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, queue.Complete(message))
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	message, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, queue.MoveToDeadLetter(message))
+
+	assert.Equal(t, []queues.QueueEvent{
+		queues.QueueEventSend,
+		queues.QueueEventReceive,
+		queues.QueueEventAbandon,
+		queues.QueueEventReceive,
+		queues.QueueEventComplete,
+		queues.QueueEventSend,
+		queues.QueueEventReceive,
+		queues.QueueEventDeadLetter,
+	}, listener.events)
+
+	// Removed listeners are not notified
+	queue.RemoveEventListener(listener)
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	assert.Len(t, listener.events, 8)
+}
+
+func TestMemoryMessageQueueLockedMessageCount(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 0; i < 5; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+
+	messages, err := queue.ReceiveBatch("", 2, 10000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 2)
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(3), count)
+	locked, _ := queue.ReadLockedMessageCount()
+	assert.Equal(t, int64(2), locked)
+	total, _ := queue.ReadTotalMessageCount()
+	assert.Equal(t, int64(5), total)
+
+	assert.Nil(t, queue.Complete(messages[0]))
+	assert.Nil(t, queue.Abandon(messages[1]))
+
+	count, _ = queue.ReadMessageCount()
+	assert.Equal(t, int64(4), count)
+	locked, _ = queue.ReadLockedMessageCount()
+	assert.Equal(t, int64(0), locked)
+	total, _ = queue.ReadTotalMessageCount()
+	assert.Equal(t, int64(4), total)
+}
+
+func TestMemoryMessageQueueCloseCallback(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+
+	var leftovers []*queues.MessageEnvelope
+	queue.SetCloseCallback(func(correlationId string, messages []*queues.MessageEnvelope) {
+		leftovers = messages
+	})
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 2")))
+	_, err := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, err)
+
+	queue.Close("")
+
+	assert.Len(t, leftovers, 2)
+	assert.Equal(t, "Message 2", leftovers[0].GetMessageAsString())
+	assert.Equal(t, "Message 1", leftovers[1].GetMessageAsString())
+
+	// Closing an empty queue does not call the callback
+	leftovers = nil
+	queue = queues.NewMemoryMessageQueue("TestQueue")
+	queue.SetCloseCallback(func(correlationId string, messages []*queues.MessageEnvelope) {
+		leftovers = messages
+	})
+	queue.Open("")
+	queue.Close("")
+	assert.Nil(t, leftovers)
+}
+
+func TestMemoryMessageQueueSendValidate(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("send.validate", true))
+	queue.Open("")
+	defer queue.Close("")
+
+	err := queue.Send("", queues.NewMessageEnvelope("123", "", []byte("Test message")))
+	assert.True(t, errors.Is(err, queues.ErrInvalidMessageEnvelope))
+
+	err = queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	assert.Nil(t, err)
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryMessageQueueTraceContext(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+	envelope.SetTraceContext("trace1", "span1")
+	queue.Send("", envelope)
+
+	message, err := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, err)
+	traceId, spanId := message.GetTraceContext()
+	assert.Equal(t, "trace1", traceId)
+	assert.Equal(t, "span1", spanId)
+}
+
+func TestMemoryMessageQueueBlockingListen(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("receive.poll_interval", 100))
+	queue.Open("")
+	defer queue.Close("")
+
+	receiver := queues.NewMockMessageReceiver()
+	done := make(chan error)
+	go func() {
+		done <- queue.BlockingListen("", receiver)
+	}()
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	assert.Eventually(t, func() bool { return receiver.Count() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case <-done:
+		assert.Fail(t, "BlockingListen returned before EndListen")
+	default:
+	}
+
+	queue.EndListen("")
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "BlockingListen did not return after EndListen")
+	}
+}
+
+func TestMemoryMessageQueueDefaultMessageType(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("send.default_message_type", "DefaultType"))
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "", []byte("Message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 2")))
+
+	message, err := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, "DefaultType", message.MessageType)
+
+	message, err = queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, "Test", message.MessageType)
+}
+
+func TestMemoryMessageQueueWithoutReferences(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	assert.NotNil(t, queue.Logger)
+	assert.NotNil(t, queue.Counters)
+
+	assert.Nil(t, queue.Open(""))
+	defer queue.Close("")
+
+	assert.Nil(t, queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message"))))
+
+	message, err := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.NotNil(t, message)
+	assert.Nil(t, queue.Complete(message))
+}
+
+func TestMemoryMessageQueueReceiveReply(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	var wg sync.WaitGroup
+	replies := make(map[string]*queues.MessageEnvelope)
+	var lock sync.Mutex
+	for _, correlationId := range []string{"A", "B"} {
+		wg.Add(1)
+		go func(correlationId string) {
+			defer wg.Done()
+			message, err := queue.ReceiveReply(correlationId, 10000*time.Millisecond)
+			assert.Nil(t, err)
+			lock.Lock()
+			replies[correlationId] = message
+			lock.Unlock()
+		}(correlationId)
+	}
+
+	queue.Send("", queues.NewMessageEnvelope("B", "Reply", []byte("Reply B")))
+	queue.Send("", queues.NewMessageEnvelope("C", "Reply", []byte("Reply C")))
+	queue.Send("", queues.NewMessageEnvelope("A", "Reply", []byte("Reply A")))
+	wg.Wait()
+
+	assert.Equal(t, "Reply A", replies["A"].GetMessageAsString())
+	assert.Equal(t, "Reply B", replies["B"].GetMessageAsString())
+
+	// Non-matching message stays in the queue
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+
+	message, err := queue.ReceiveReply("D", 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, message)
+}
+
+func TestMemoryMessageQueuePurge(t *testing.T) {
+	counters := newMockCounters()
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("test", "counters", "mock", "default", "1.0"), counters,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 0; i < 4; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	}
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, queue.MoveToDeadLetter(message))
+	_, _ = queue.Receive("", 10000*time.Millisecond)
+
+	count, err := queue.Purge("")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), count)
+	assert.Equal(t, int64(4), counters.GetCount("queue.TestQueue.purged_messages"))
+
+	total, _ := queue.ReadTotalMessageCount()
+	assert.Equal(t, int64(0), total)
+	dead, _ := queue.ReadDeadLetterCount()
+	assert.Equal(t, int64(0), dead)
+
+	count, err = queue.Purge("")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestMemoryMessageQueueJSONL(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 1")))
+	queue.Send("", queues.NewMessageEnvelope("456", "Test", []byte("Message 2")))
+
+	// Delivery counts are not carried over into the restored queue
+	message1, _ := queue.Receive("", 0)
+	message2, _ := queue.Receive("", 0)
+	queue.Abandon(message1)
+	queue.Abandon(message2)
+
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	count, err := queue.ExportJSONL(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	restored := queues.NewMemoryMessageQueue("RestoredQueue")
+	restored.Open("")
+	defer restored.Close("")
+
+	count, err = restored.ImportJSONL(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	message, _ := restored.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "123", message.CorrelationId)
+	assert.Equal(t, "Message 1", message.GetMessageAsString())
+	assert.Equal(t, 1, message.DeliveryCount)
+	message, _ = restored.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "456", message.CorrelationId)
+	assert.Equal(t, "Message 2", message.GetMessageAsString())
+}
+
+func TestMemoryMessageQueueImportMalformedJSONL(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	data := "{\"message_type\":\"Test\",\"message\":\"QUJD\"}\n\nnot a json\n"
+	assert.Nil(t, os.WriteFile(path, []byte(data), 0644))
+
+	count, err := queue.ImportJSONL(path)
+	assert.True(t, errors.Is(err, queues.ErrInvalidMessageEnvelope))
+	assert.Contains(t, err.Error(), "line 3")
+	assert.Equal(t, 0, count)
+
+	total, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), total)
+}
+
+func TestMemoryMessageQueueListenLockTimeout(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"receive.poll_interval", 50,
+		"receive.min_poll_interval", 10,
+		"listen.ack_mode", "auto",
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	var deliveries int32
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		atomic.AddInt32(&deliveries, 1)
+		// Processing takes longer than the poll interval
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	go queue.Listen("", receiver)
+
+	assert.Eventually(t, func() bool {
+		stats := queue.GetStats()
+		return stats.PendingCount == 0 && stats.LockedCount == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	queue.EndListen("")
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deliveries))
+}
+
+func TestMemoryMessageQueueAdaptiveListenInterval(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"receive.min_poll_interval", 10,
+		"receive.max_poll_interval", 200,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	intervals := make(chan time.Duration, 10)
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		intervals <- queue.(*queues.MemoryMessageQueue).GetListenInterval()
+		return queue.Complete(message)
+	})
+	queue.BeginListen("", receiver)
+	defer queue.EndListen("")
+
+	// Idle queue backs off to the maximum interval
+	assert.Eventually(t, func() bool {
+		return queue.GetListenInterval() == 200*time.Millisecond
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Flowing messages shrink the interval to the minimum
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	select {
+	case interval := <-intervals:
+		assert.Equal(t, 10*time.Millisecond, interval)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Message was not received")
+	}
+}
+
+func TestMemoryMessageQueueRewind(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("retain.max_count", 2))
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 1; i <= 3; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message "+strconv.Itoa(i))))
+		message, _ := queue.Receive("", 10000*time.Millisecond)
+		assert.Nil(t, queue.Complete(message))
+	}
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+
+	// Only the last two messages are retained
+	assert.Nil(t, queue.Rewind(""))
+	count, _ = queue.ReadMessageCount()
+	assert.Equal(t, int64(2), count)
+
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Message 2", message.GetMessageAsString())
+	message, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Message 3", message.GetMessageAsString())
+}
+
+func TestMemoryMessageQueueRewindCapacity(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"capacity", 2,
+		"send.blocking", false,
+		"retain.max_count", 2,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	for i := 1; i <= 2; i++ {
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message "+strconv.Itoa(i))))
+		message, _ := queue.Receive("", 10000*time.Millisecond)
+		assert.Nil(t, queue.Complete(message))
+	}
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 3")))
+
+	// Only one retained message fits and the other one stays retained
+	err := queue.Rewind("")
+	assert.True(t, errors.Is(err, queues.ErrQueueOverflow))
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(2), count)
+
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Message 3", message.GetMessageAsString())
+	message, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Message 1", message.GetMessageAsString())
+
+	assert.Nil(t, queue.Rewind(""))
+	message, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Message 2", message.GetMessageAsString())
+
+	queue.Close("")
+	err = queue.Rewind("")
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+}
+
+func TestMemoryMessageQueueOpenWithReferences(t *testing.T) {
+	discovery := cconn.NewEmptyMemoryDiscovery()
+	discovery.Register("", "queue-key", cconn.NewConnectionParamsFromTuples("protocol", "memory"))
+	discovery.Register("", "bad-key", cconn.NewConnectionParamsFromTuples("protocol", "amqp"))
+	references := cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "discovery", "memory", "default", "1.0"), discovery,
+	)
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("connection.discovery_key", "queue-key"))
+	queue.SetReferences(references)
+	assert.Nil(t, queue.Open(""))
+	assert.True(t, queue.IsOpen())
+	queue.Close("")
+
+	queue = queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("connection.discovery_key", "bad-key"))
+	queue.SetReferences(references)
+	err := queue.Open("")
+	assert.NotNil(t, err)
+	assert.Equal(t, "UNSUPPORTED_PROTOCOL", err.(*cerr.ApplicationError).Code)
+	assert.False(t, queue.IsOpen())
+}
+
+func TestMemoryMessageQueuePeekBatchRefs(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 2")))
+
+	messages, err := queue.PeekBatchRefs("", 10)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "Message 1", messages[0].GetMessageAsString())
+	assert.Equal(t, "Message 2", messages[1].GetMessageAsString())
+
+	// Copies returned by PeekBatch do not affect the queue
+	copies, err := queue.PeekBatch("", 10)
+	assert.Nil(t, err)
+	copies[0].Message[0] = 'X'
+	copies[0].SetHeader("key", "value")
+
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Message 1", message.GetMessageAsString())
+	_, ok := message.GetHeader("key")
+	assert.False(t, ok)
+}
+
+func TestMemoryMessageQueueGenerateCorrelationId(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("send.generate_correlation_id", true))
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("", "Test", []byte("Message 1"))
+	queue.Send("", envelope)
+	assert.NotEqual(t, "", envelope.CorrelationId)
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 2")))
+
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, envelope.CorrelationId, message.CorrelationId)
+	message, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "123", message.CorrelationId)
+
+	// Correlation ids are not generated by default
+	queue = queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope = queues.NewMessageEnvelope("", "Test", []byte("Message 1"))
+	queue.Send("", envelope)
+	assert.Equal(t, "", envelope.CorrelationId)
+}
+
+func TestMemoryMessageQueueDeadLetterReason(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("max_delivery_count", 1))
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 2")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 3")))
+
+	message, _ := queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, queue.MoveToDeadLetterWithReason(message, "invalid payload"))
+	message, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, queue.MoveToDeadLetter(message))
+	message, _ = queue.Receive("", 10000*time.Millisecond)
+	assert.Nil(t, queue.Abandon(message))
+
+	deadLetters, err := queue.PeekDeadLetter("")
+	assert.Nil(t, err)
+	assert.Len(t, deadLetters, 3)
+
+	reason, ok := deadLetters[0].GetHeader(queues.DeadLetterReasonHeader)
+	assert.True(t, ok)
+	assert.Equal(t, "invalid payload", reason)
+
+	_, ok = deadLetters[1].GetHeader(queues.DeadLetterReasonHeader)
+	assert.False(t, ok)
+
+	reason, _ = deadLetters[2].GetHeader(queues.DeadLetterReasonHeader)
+	assert.Equal(t, "maximum delivery count exceeded", reason)
+}
+
+func TestMemoryMessageQueueReplyTo(t *testing.T) {
+	requests := queues.NewMemoryMessageQueue("Requests")
+	requests.Open("")
+	defer requests.Close("")
+	replies := queues.NewMemoryMessageQueue("Replies")
+	replies.Open("")
+	defer replies.Close("")
+
+	request := queues.NewMessageEnvelope("123", "Request", []byte("ping"))
+	request.SetReplyTo(replies.Name())
+	requests.Send("", request)
+
+	received, _ := requests.Receive("", 10000*time.Millisecond)
+	assert.Equal(t, "Replies", received.GetReplyTo())
+	replies.Send("", queues.NewMessageEnvelope(received.CorrelationId, "Reply", []byte("pong")))
+	requests.Complete(received)
+
+	reply, err := replies.ReceiveReply("123", 10000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, "pong", reply.GetMessageAsString())
+	assert.Equal(t, "", reply.GetReplyTo())
+}
+
+func TestMemoryMessageQueueListenTwice(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("receive.poll_interval", 100))
+	queue.Open("")
+	defer queue.Close("")
+
+	receiver := queues.NewMockMessageReceiver()
+	done := make(chan error)
+	go func() {
+		done <- queue.Listen("", receiver)
+	}()
+
+	// Wait until the first listener is active
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	assert.Eventually(t, func() bool { return receiver.Count() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	err := queue.Listen("", receiver)
+	assert.True(t, errors.Is(err, queues.ErrAlreadyListening))
+
+	queue.EndListen("")
+	assert.Nil(t, <-done)
+
+	// Listening can start again after the previous listener stopped
+	go func() {
+		done <- queue.Listen("", receiver)
+	}()
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	assert.Eventually(t, func() bool { return receiver.Count() == 2 }, 5*time.Second, 10*time.Millisecond)
+	queue.EndListen("")
+	assert.Nil(t, <-done)
+}
+
+func TestMemoryMessageQueueByteSize(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	size, err := queue.ReadQueueByteSize()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	message1 := queues.NewMessageEnvelope("123", "Test", make([]byte, 100))
+	message2 := queues.NewMessageEnvelope("123", "Test", make([]byte, 200))
+	queue.Send("", message1)
+	queue.Send("", message2)
+
+	size, _ = queue.ReadQueueByteSize()
+	assert.Equal(t, int64(message1.Size()+message2.Size()), size)
+
+	queue.Receive("", 10000*time.Millisecond)
+	size, _ = queue.ReadQueueByteSize()
+	assert.Equal(t, int64(message2.Size()), size)
+}
+
+func TestMemoryMessageQueueCompleteNotReceived(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
+
+	err := queue.Complete(envelope)
+	assert.True(t, errors.Is(err, queues.ErrMessageNotReceived))
+	assert.True(t, errors.Is(err, queues.ErrMessageNotLocked))
+
+	err = queue.Abandon(envelope)
+	assert.True(t, errors.Is(err, queues.ErrMessageNotReceived))
+
+	err = queue.Complete(nil)
+	assert.True(t, errors.Is(err, queues.ErrMessageNotReceived))
+
+	err = queue.Abandon(nil)
+	assert.True(t, errors.Is(err, queues.ErrMessageNotReceived))
+}
+
+func TestMemoryMessageQueueAutoAck(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"listen.ack_mode", "auto",
+		"receive.poll_interval", 10000,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	var processed int32
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		atomic.AddInt32(&processed, 1)
+		if message.MessageType == "Fail" && message.DeliveryCount == 1 {
+			return errors.New("processing failed")
+		}
+		return nil
+	})
+	queue.BeginListen("", receiver)
+	defer queue.EndListen("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Fail", []byte("Message 2")))
+
+	// Failed message is abandoned and processed again, then both are completed
+	assert.Eventually(t, func() bool {
+		total, _ := queue.ReadTotalMessageCount()
+		return atomic.LoadInt32(&processed) == 3 && total == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryMessageQueueManualAck(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples("receive.poll_interval", 10000))
+	queue.Open("")
+	defer queue.Close("")
+
+	var processed int32
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		atomic.AddInt32(&processed, 1)
+		return nil
+	})
+	queue.BeginListen("", receiver)
+	defer queue.EndListen("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Message 1")))
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&processed) == 1 }, 5*time.Second, 10*time.Millisecond)
+	locked, _ := queue.ReadLockedMessageCount()
+	assert.Equal(t, int64(1), locked)
+}
+
+func TestMemoryMessageQueuePing(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	assert.True(t, errors.Is(queue.Ping(""), queues.ErrQueueClosed))
+
+	queue.Open("")
+	assert.Nil(t, queue.Ping(""))
+
+	queue.Close("")
+	assert.True(t, errors.Is(queue.Ping(""), queues.ErrQueueClosed))
+}
+
+type orderValidator struct{}
+
+var errInvalidOrder = errors.New("order shall be a valid JSON")
+
+func (c *orderValidator) ValidateMessage(message *queues.MessageEnvelope) error {
+	if message.MessageType == "order" && !json.Valid(message.Message) {
+		return errInvalidOrder
+	}
+	return nil
+}
+
+func TestMemoryMessageQueueValidator(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"send.invalid_dead_letter", true,
+	))
+	queue.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("test", "validator", "order", "default", "1.0"), &orderValidator{},
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	err := queue.Send("", queues.NewMessageEnvelope("123", "order", []byte("{bad")))
+	assert.True(t, errors.Is(err, errInvalidOrder))
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(0), count)
+
+	deadLetters, _ := queue.PeekDeadLetter("")
+	assert.Len(t, deadLetters, 1)
+	reason, _ := deadLetters[0].GetHeader(queues.DeadLetterReasonHeader)
+	assert.Equal(t, "validation failed: "+errInvalidOrder.Error(), reason)
+
+	err = queue.Send("", queues.NewMessageEnvelope("123", "order", []byte(`{"id":"1"}`)))
+	assert.Nil(t, err)
+
+	count, _ = queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryMessageQueueReceiveInto(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	message := &queues.MessageEnvelope{}
+
+	ok, err := queue.ReceiveInto("", message, 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+
+	ok, err = queue.ReceiveInto("", message, 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "Test message 1", message.GetMessageAsString())
+	assert.NotNil(t, message.GetReference())
+
+	err = queue.Complete(message)
+	assert.Nil(t, err)
+
+	ok, err = queue.ReceiveInto("", message, 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "Test message 2", message.GetMessageAsString())
+
+	count, _ := queue.ReadLockedMessageCount()
+	assert.Equal(t, int64(1), count)
+
+	err = queue.Abandon(message)
+	assert.Nil(t, err)
+
+	count, _ = queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+
+	// Lock record released by the first message is reused
+	ok, err = queue.ReceiveInto("", message, 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "Test message 2", message.GetMessageAsString())
+	assert.Equal(t, 2, message.DeliveryCount)
+	assert.Nil(t, queue.Complete(message))
+}
+
+func TestMemoryMessageQueueDeliveryOrder(t *testing.T) {
+	receiveAll := func(queue *queues.MemoryMessageQueue) []string {
+		result := []string{}
+		for {
+			message, _ := queue.TryReceive("")
+			if message == nil {
+				return result
+			}
+			result = append(result, message.GetMessageAsString())
+			queue.Complete(message)
+		}
+	}
+
+	send := func(queue *queues.MemoryMessageQueue, text string, priority int) {
+		envelope := queues.NewMessageEnvelope("123", "Test", []byte(text))
+		envelope.Priority = priority
+		queue.Send("", envelope)
+	}
+
+	t.Run("FIFO", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Open("")
+		defer queue.Close("")
+
+		send(queue, "1", 0)
+		send(queue, "2", 0)
+		send(queue, "3", 0)
+
+		message, _ := queue.Peek("")
+		assert.Equal(t, "1", message.GetMessageAsString())
+		assert.Equal(t, []string{"1", "2", "3"}, receiveAll(queue))
+	})
+
+	t.Run("LIFO", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Configure(cconf.NewConfigParamsFromTuples("delivery_order", "lifo"))
+		queue.Open("")
+		defer queue.Close("")
+
+		send(queue, "1", 0)
+		send(queue, "2", 0)
+		send(queue, "3", 0)
+
+		message, _ := queue.Peek("")
+		assert.Equal(t, "3", message.GetMessageAsString())
+		assert.Equal(t, []string{"3", "2", "1"}, receiveAll(queue))
+	})
+
+	t.Run("LIFO Priority", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Configure(cconf.NewConfigParamsFromTuples("delivery_order", "lifo"))
+		queue.Open("")
+		defer queue.Close("")
+
+		send(queue, "1", 1)
+		send(queue, "2", 0)
+		send(queue, "3", 1)
+		send(queue, "4", 0)
+
+		assert.Equal(t, []string{"3", "1", "4", "2"}, receiveAll(queue))
+	})
+
+	t.Run("LIFO Abandon", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Configure(cconf.NewConfigParamsFromTuples("delivery_order", "lifo"))
+		queue.Open("")
+		defer queue.Close("")
+
+		send(queue, "1", 0)
+		send(queue, "2", 0)
+
+		message, _ := queue.TryReceive("")
+		assert.Equal(t, "2", message.GetMessageAsString())
+		queue.Abandon(message)
+
+		assert.Equal(t, []string{"1", "2"}, receiveAll(queue))
+	})
+
+	t.Run("LIFO Abandon Preserve Order", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Configure(cconf.NewConfigParamsFromTuples(
+			"delivery_order", "lifo",
+			"abandon.preserve_order", true,
+		))
+		queue.Open("")
+		defer queue.Close("")
+
+		send(queue, "1", 0)
+		send(queue, "2", 0)
+
+		message, _ := queue.TryReceive("")
+		queue.Abandon(message)
+
+		assert.Equal(t, []string{"2", "1"}, receiveAll(queue))
+	})
+}
+
+func TestMemoryMessageQueueSendWithTimeout(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"capacity", 1,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	err := queue.SendWithTimeout("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")), 50*time.Millisecond)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	err = queue.SendWithTimeout("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")), 50*time.Millisecond)
+	assert.True(t, errors.Is(err, queues.ErrSendTimeout))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	count, _ := queue.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+
+	// Space becomes available while waiting
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		message, _ := queue.TryReceive("")
+		queue.Complete(message)
+	}()
+
+	err = queue.SendWithTimeout("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 3")), time.Second)
+	assert.Nil(t, err)
+
+	message, _ := queue.Peek("")
+	assert.Equal(t, "Test message 3", message.GetMessageAsString())
+}
+
+func TestMemoryMessageQueueDepthSampling(t *testing.T) {
+	counters := newMockCounters()
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"depth.sample_interval", 10,
+	))
+	queue.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("test", "counters", "mock", "default", "1.0"), counters,
+	))
+	queue.Open("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+
+	assert.Eventually(t, func() bool {
+		stats := counters.GetStats("queue.TestQueue.depth")
+		return len(stats) > 0 && stats[len(stats)-1] == 2
+	}, time.Second, 5*time.Millisecond)
+
+	queue.Close("")
+
+	// No samples are recorded after the queue is closed
+	time.Sleep(20 * time.Millisecond)
+	count := len(counters.GetStats("queue.TestQueue.depth"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, count, len(counters.GetStats("queue.TestQueue.depth")))
+}
+
+func TestMemoryMessageQueueMessageGroups(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	lock := sync.Mutex{}
+	processed := map[string][]string{}
+	inFlight := map[string]int{}
+	overlaps := 0
+	var groupsInFlight int32
+	var maxGroupsInFlight int32
+
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		lock.Lock()
+		inFlight[message.GroupId]++
+		if inFlight[message.GroupId] > 1 {
+			overlaps++
+		}
+		lock.Unlock()
+
+		current := atomic.AddInt32(&groupsInFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxGroupsInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxGroupsInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&groupsInFlight, -1)
+
+		lock.Lock()
+		inFlight[message.GroupId]--
+		processed[message.GroupId] = append(processed[message.GroupId], message.GetMessageAsString())
+		lock.Unlock()
+
+		return queue.Complete(message)
+	})
+
+	// Interleave messages of two groups
+	for i := 0; i < 5; i++ {
+		for _, group := range []string{"A", "B"} {
+			envelope := queues.NewMessageEnvelope("123", "Test", []byte(group+strconv.Itoa(i)))
+			envelope.GroupId = group
+			queue.Send("", envelope)
+		}
+	}
+
+	go queue.ListenWithWorkers("", receiver, 4)
+	defer queue.EndListen("")
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(processed["A"]) == 5 && len(processed["B"]) == 5
+	}, 2*time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 0, overlaps)
+	assert.Equal(t, []string{"A0", "A1", "A2", "A3", "A4"}, processed["A"])
+	assert.Equal(t, []string{"B0", "B1", "B2", "B3", "B4"}, processed["B"])
+	// Groups are processed in parallel
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxGroupsInFlight))
+}
+
+func TestMemoryMessageQueueMessageGroupsRequeue(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var clockLock sync.Mutex
+	clock := func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"lock.reaper_interval", 0,
+	))
+	queue.SetClock(clock)
+	queue.Open("")
+	defer queue.Close("")
+
+	for _, body := range []string{"A0", "A1", "B0"} {
+		envelope := queues.NewMessageEnvelope("123", "Test", []byte(body))
+		envelope.GroupId = body[:1]
+		queue.Send("", envelope)
+	}
+
+	// Abandoned message goes ahead of later messages of its group
+	message, _ := queue.Receive("", time.Second)
+	assert.Equal(t, "A0", message.GetMessageAsString())
+	assert.Nil(t, queue.Abandon(message))
+
+	message, _ = queue.Receive("", time.Second)
+	assert.Equal(t, "A0", message.GetMessageAsString())
+
+	// Message with expired lock also goes ahead of later messages of its group
+	clockLock.Lock()
+	now = now.Add(2 * time.Second)
+	clockLock.Unlock()
+
+	err := queue.Complete(message)
+	assert.True(t, errors.Is(err, queues.ErrLockExpired))
+
+	message, _ = queue.Receive("", time.Second)
+	assert.Equal(t, "A0", message.GetMessageAsString())
+
+	// Message released by the lock sweep keeps its position too
+	clockLock.Lock()
+	now = now.Add(2 * time.Second)
+	clockLock.Unlock()
+
+	count, err := queue.SweepExpiredLocks()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	message, _ = queue.Receive("", time.Second)
+	assert.Equal(t, "A0", message.GetMessageAsString())
+	assert.Nil(t, queue.Complete(message))
+
+	message, _ = queue.Receive("", time.Second)
+	assert.Equal(t, "A1", message.GetMessageAsString())
+}
+
+func TestMemoryMessageQueueMessageGroupsDelayedHead(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var clockLock sync.Mutex
+	clock := func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.SetClock(clock)
+	queue.Open("")
+	defer queue.Close("")
+
+	for _, body := range []string{"A0", "A1", "B0"} {
+		envelope := queues.NewMessageEnvelope("123", "Test", []byte(body))
+		envelope.GroupId = body[:1]
+		queue.Send("", envelope)
+	}
+
+	message, _ := queue.TryReceive("")
+	assert.Equal(t, "A0", message.GetMessageAsString())
+
+	// Messages of a locked group are not peeked
+	peeked, _ := queue.Peek("")
+	assert.Equal(t, "B0", peeked.GetMessageAsString())
+
+	// Delayed message holds back later messages of its group
+	assert.Nil(t, queue.AbandonWithDelay(message, time.Minute))
+	peeked, _ = queue.Peek("")
+	assert.Equal(t, "B0", peeked.GetMessageAsString())
+
+	message, _ = queue.TryReceive("")
+	assert.Equal(t, "B0", message.GetMessageAsString())
+	assert.Nil(t, queue.Complete(message))
+	message, _ = queue.TryReceive("")
+	assert.Nil(t, message)
+
+	clockLock.Lock()
+	now = now.Add(2 * time.Minute)
+	clockLock.Unlock()
+
+	message, _ = queue.TryReceive("")
+	assert.Equal(t, "A0", message.GetMessageAsString())
+	assert.Nil(t, queue.Complete(message))
+	message, _ = queue.TryReceive("")
+	assert.Equal(t, "A1", message.GetMessageAsString())
+}
+
+func TestMemoryMessageQueueMessageGroupsLifo(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"delivery_order", "lifo",
+		"abandon.preserve_order", true,
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	for _, body := range []string{"A0", "A1", "B0", "A2"} {
+		envelope := queues.NewMessageEnvelope("123", "Test", []byte(body))
+		envelope.GroupId = body[:1]
+		queue.Send("", envelope)
+	}
+
+	// Groups are taken newest first, but messages within a group go in the order they were sent
+	message, _ := queue.TryReceive("")
+	assert.Equal(t, "B0", message.GetMessageAsString())
+	assert.Nil(t, queue.Complete(message))
+
+	message, _ = queue.TryReceive("")
+	assert.Equal(t, "A0", message.GetMessageAsString())
+	assert.Nil(t, queue.Abandon(message))
+
+	// Abandoned message stays at the head of its group
+	received := []string{}
+	for {
+		message, _ = queue.TryReceive("")
+		if message == nil {
+			break
+		}
+		received = append(received, message.GetMessageAsString())
+		assert.Nil(t, queue.Complete(message))
+	}
+	assert.Equal(t, []string{"A0", "A1", "A2"}, received)
+}
+
+func TestMemoryMessageQueueSweepExpiredLocks(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var clockLock sync.Mutex
+	clock := func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"lock.reaper_interval", 0,
+	))
+	queue.SetClock(clock)
+	queue.Open("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+
+	expiring, _ := queue.Receive("", 100*time.Millisecond)
+	assert.NotNil(t, expiring)
+	// Message is available, so the receive does not wait and only locks it for longer
+	locked, _ := queue.Receive("", 10*time.Second)
+	assert.NotNil(t, locked)
+
+	count, err := queue.SweepExpiredLocks()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// Move the clock past the first lock
+	clockLock.Lock()
+	now = now.Add(time.Second)
+	clockLock.Unlock()
+
+	count, err = queue.SweepExpiredLocks()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	message, _ := queue.Peek("")
+	assert.Equal(t, "Test message 1", message.GetMessageAsString())
+
+	lockedCount, _ := queue.ReadLockedMessageCount()
+	assert.Equal(t, int64(1), lockedCount)
+
+	queue.Close("")
+	_, err = queue.SweepExpiredLocks()
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+}
+
+func TestMemoryMessageQueueErrors(t *testing.T) {
+	t.Run("Queue Closed", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Open("")
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		received, _ := queue.Receive("", 100*time.Millisecond)
+		queue.Close("")
+
+		err := queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+		_, err = queue.Receive("", 10*time.Millisecond)
+		assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+		_, err = queue.Peek("")
+		assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+		err = queue.Complete(received)
+		assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+	})
+
+	t.Run("Message Not Locked", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Open("")
+		defer queue.Close("")
+
+		err := queue.Complete(queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		assert.True(t, errors.Is(err, queues.ErrMessageNotLocked))
+		err = queue.Abandon(queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		assert.True(t, errors.Is(err, queues.ErrMessageNotLocked))
+	})
+
+	t.Run("Lock Expired", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Configure(cconf.NewConfigParamsFromTuples(
+			"lock.reaper_interval", 0,
+		))
+		queue.Open("")
+		defer queue.Close("")
+
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		received, _ := queue.Receive("", 10*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+
+		err := queue.Complete(received)
+		assert.True(t, errors.Is(err, queues.ErrLockExpired))
+	})
+
+	t.Run("Queue Overflow", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Configure(cconf.NewConfigParamsFromTuples(
+			"capacity", 1,
+			"send.blocking", false,
+		))
+		queue.Open("")
+		defer queue.Close("")
+
+		queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		err := queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		assert.True(t, errors.Is(err, queues.ErrQueueOverflow))
+	})
+
+	t.Run("Message Too Large", func(t *testing.T) {
+		queue := queues.NewMemoryMessageQueue("TestQueue")
+		queue.Configure(cconf.NewConfigParamsFromTuples(
+			"max_message_size", 4,
+		))
+		queue.Open("")
+		defer queue.Close("")
+
+		err := queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+		assert.True(t, errors.Is(err, queues.ErrMessageTooLarge))
+	})
+}
+
+func TestMemoryMessageQueueReceiveChan(t *testing.T) {
+	queue1 := queues.NewMemoryMessageQueue("TestQueue1")
+	queue1.Open("")
+	defer queue1.Close("")
+
+	queue2 := queues.NewMemoryMessageQueue("TestQueue2")
+	queue2.Open("")
+	defer queue2.Close("")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages1 := queue1.ReceiveChan(ctx)
+	messages2 := queue2.ReceiveChan(ctx)
+
+	queue1.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	queue2.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+
+	received := []string{}
+	for len(received) < 2 {
+		select {
+		case message := <-messages1:
+			received = append(received, message.GetMessageAsString())
+			// Delivered messages stay locked until completed
+			count, _ := queue1.ReadLockedMessageCount()
+			assert.Equal(t, int64(1), count)
+			assert.Nil(t, queue1.Complete(message))
+		case message := <-messages2:
+			received = append(received, message.GetMessageAsString())
+			assert.Nil(t, queue2.Complete(message))
+		case <-time.After(time.Second):
+			t.Fatal("Messages were not delivered")
+		}
+	}
+	assert.ElementsMatch(t, []string{"Test message 1", "Test message 2"}, received)
+
+	cancel()
+
+	// Channels are closed after the context is done
+	for _, messages := range []<-chan *queues.MessageEnvelope{messages1, messages2} {
+		select {
+		case _, ok := <-messages:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("Channel was not closed")
+		}
+	}
+
+	queue1.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 3")))
+	count, _ := queue1.ReadMessageCount()
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryMessageQueueSnapshot(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 1")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 3")))
+
+	received, _ := queue.Receive("", 10*time.Second)
+	dead, _ := queue.Receive("", 10*time.Second)
+	queue.MoveToDeadLetter(dead)
+
+	snapshot := queue.Snapshot()
+	assert.Len(t, snapshot.Messages, 1)
+	assert.Equal(t, "Test message 3", snapshot.Messages[0].GetMessageAsString())
+	assert.Len(t, snapshot.LockedMessages, 1)
+	assert.Equal(t, received.MessageId, snapshot.LockedMessages[0].Message.MessageId)
+	assert.Equal(t, received.GetReference(), snapshot.LockedMessages[0].LockToken)
+	assert.True(t, snapshot.LockedMessages[0].ExpirationTime.After(time.Now()))
+	assert.Len(t, snapshot.DeadLetters, 1)
+	assert.Equal(t, "Test message 2", snapshot.DeadLetters[0].GetMessageAsString())
+
+	// Snapshot does not change the queue
+	snapshot.Messages[0].Message = []byte("Changed")
+	stats := queue.GetStats()
+	assert.Equal(t, int64(1), stats.PendingCount)
+	assert.Equal(t, int64(1), stats.LockedCount)
+	assert.Equal(t, int64(1), stats.DeadCount)
+
+	message, _ := queue.Peek("")
+	assert.Equal(t, "Test message 3", message.GetMessageAsString())
+	assert.Nil(t, queue.Complete(received))
+}
+
+func TestMemoryMessageQueueIdGenerator(t *testing.T) {
+	var sequence int64
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.SetIdGenerator(func() string {
+		return "msg-" + strconv.FormatInt(atomic.AddInt64(&sequence, 1), 10)
+	})
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", &queues.MessageEnvelope{MessageType: "Test", Message: []byte("Test message 1")})
+	queue.Send("", &queues.MessageEnvelope{MessageType: "Test", Message: []byte("Test message 2")})
+	// Messages with ids keep them
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 3")))
+	explicit := &queues.MessageEnvelope{MessageId: "custom", MessageType: "Test", Message: []byte("Test message 4")}
+	queue.Send("", explicit)
+
+	ids := []string{}
+	for {
+		message, _ := queue.TryReceive("")
+		if message == nil {
+			break
+		}
+		ids = append(ids, message.MessageId)
+		queue.Complete(message)
+	}
+
+	assert.Len(t, ids, 4)
+	assert.Equal(t, "msg-1", ids[0])
+	assert.Equal(t, "msg-2", ids[1])
+	assert.NotEqual(t, "msg-3", ids[2])
+	assert.Equal(t, "custom", ids[3])
+}
+
+func TestMemoryMessageQueuePromoteMessage(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 1"))
+	envelope2 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 2"))
+	envelope3 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 3"))
+	queue.Send("", envelope1)
+	queue.Send("", envelope2)
+	queue.Send("", envelope3)
+
+	ok, err := queue.PromoteMessage(envelope3.MessageId)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = queue.PromoteMessage("unknown")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	for _, expected := range []*queues.MessageEnvelope{envelope3, envelope1, envelope2} {
+		message, _ := queue.TryReceive("")
+		assert.Equal(t, expected.MessageId, message.MessageId)
+		queue.Complete(message)
+	}
+
+	// Delayed messages keep their delay
+	queue.SendDelayed("", envelope1, time.Hour)
+	queue.Send("", envelope2)
+	ok, _ = queue.PromoteMessage(envelope1.MessageId)
+	assert.True(t, ok)
+
+	message, _ := queue.TryReceive("")
+	assert.Equal(t, envelope2.MessageId, message.MessageId)
+	queue.Complete(message)
+
+	message, _ = queue.TryReceive("")
+	assert.Nil(t, message)
+}
@@ -0,0 +1,158 @@
+package test_queues
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
+)
+
+type messageCollector struct {
+	lock     sync.Mutex
+	messages []*queues.MessageEnvelope
+}
+
+func (c *messageCollector) ReceiveMessage(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+	c.lock.Lock()
+	c.messages = append(c.messages, message)
+	c.lock.Unlock()
+	return queue.Complete(message)
+}
+
+func (c *messageCollector) GetMessages() []*queues.MessageEnvelope {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*queues.MessageEnvelope{}, c.messages...)
+}
+
+func TestMemoryMessageTopicFanOut(t *testing.T) {
+	topic := queues.NewMemoryMessageTopic("TestTopic")
+	topic.Open("")
+	defer topic.Close("")
+
+	subscriber1 := &messageCollector{}
+	subscriber2 := &messageCollector{}
+
+	subscriptionId1, err := topic.Subscribe("", subscriber1)
+	assert.Nil(t, err)
+	subscriptionId2, err := topic.Subscribe("", subscriber2)
+	assert.Nil(t, err)
+	assert.NotEqual(t, subscriptionId1, subscriptionId2)
+	assert.Equal(t, 2, topic.ReadSubscriptionCount())
+
+	envelope := queues.NewMessageEnvelope("123", "Test", []byte("Test message 1"))
+	err = topic.Send("", envelope)
+	assert.Nil(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	messages1 := subscriber1.GetMessages()
+	messages2 := subscriber2.GetMessages()
+	assert.Len(t, messages1, 1)
+	assert.Len(t, messages2, 1)
+	assert.Equal(t, envelope.MessageId, messages1[0].MessageId)
+	assert.Equal(t, envelope.MessageId, messages2[0].MessageId)
+	assert.Equal(t, "Test message 1", messages1[0].GetMessageAsString())
+	assert.Equal(t, "Test message 1", messages2[0].GetMessageAsString())
+	assert.True(t, messages1[0] != messages2[0])
+
+	// Unsubscribed receiver shall not get new messages
+	err = topic.Unsubscribe(subscriptionId1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, topic.ReadSubscriptionCount())
+
+	// Late subscriber receives only messages sent after subscription
+	subscriber3 := &messageCollector{}
+	_, err = topic.Subscribe("", subscriber3)
+	assert.Nil(t, err)
+
+	err = topic.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message 2")))
+	assert.Nil(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Len(t, subscriber1.GetMessages(), 1)
+	assert.Len(t, subscriber2.GetMessages(), 2)
+	assert.Len(t, subscriber3.GetMessages(), 1)
+
+	err = topic.Unsubscribe(subscriptionId1)
+	assert.True(t, errors.Is(err, queues.ErrSubscriptionNotFound))
+}
+
+func TestMemoryMessageTopicLockTimeout(t *testing.T) {
+	topic := queues.NewMemoryMessageTopic("TestTopic")
+	topic.Configure(cconf.NewConfigParamsFromTuples(
+		"receive.poll_interval", 50,
+		"receive.lock_timeout", 5000,
+	))
+	topic.Open("")
+	defer topic.Close("")
+
+	var deliveries int32
+	completed := make(chan error, 1)
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		atomic.AddInt32(&deliveries, 1)
+		// Processing takes longer than the poll interval
+		time.Sleep(200 * time.Millisecond)
+		completed <- queue.Complete(message)
+		return nil
+	})
+
+	_, err := topic.Subscribe("", receiver)
+	assert.Nil(t, err)
+	assert.Nil(t, topic.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message"))))
+
+	select {
+	case err = <-completed:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "message was not delivered")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deliveries))
+}
+
+func TestMemoryMessageTopicClosed(t *testing.T) {
+	topic := queues.NewMemoryMessageTopic("TestTopic")
+
+	err := topic.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+	_, err = topic.Subscribe("", queues.NewMockMessageReceiver())
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+	assert.Equal(t, 0, topic.ReadSubscriptionCount())
+
+	topic.Open("")
+	topic.Close("")
+
+	err = topic.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+	_, err = topic.Subscribe("", queues.NewMockMessageReceiver())
+	assert.True(t, errors.Is(err, queues.ErrQueueClosed))
+}
+
+func TestMemoryMessageTopicRecoversFromPanic(t *testing.T) {
+	topic := queues.NewMemoryMessageTopic("TestTopic")
+	topic.Open("")
+	defer topic.Close("")
+
+	var calls int32
+	collector := &messageCollector{}
+	receiver := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			panic("Test panic")
+		}
+		return collector.ReceiveMessage(message, queue)
+	})
+
+	_, err := topic.Subscribe("", receiver)
+	assert.Nil(t, err)
+	assert.Nil(t, topic.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message"))))
+
+	// The message is abandoned and delivered again
+	assert.Eventually(t, func() bool { return len(collector.GetMessages()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
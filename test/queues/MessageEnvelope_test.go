@@ -2,7 +2,11 @@ package test_queues
 
 import (
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
 	"github.com/stretchr/testify/assert"
@@ -35,8 +39,399 @@ func (c *messageEnvelopeTest) TestSerializeMessage(t *testing.T) {
 	assert.Equal(t, message.Message, message2.Message)
 }
 
+func (c *messageEnvelopeTest) TestSerializePriority(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "TestMessage", []byte("This is a test message"))
+	message.Priority = 5
+
+	buffer, err := json.Marshal(message)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buffer), "\"priority\":5")
+
+	message2 := queues.NewEmptyMessageEnvelope()
+	err = json.Unmarshal(buffer, message2)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, message2.Priority)
+}
+
+func (c *messageEnvelopeTest) TestHeaders(t *testing.T) {
+	message := queues.NewEmptyMessageEnvelope()
+
+	value, ok := message.GetHeader("tenant_id")
+	assert.False(t, ok)
+	assert.Equal(t, "", value)
+	message.RemoveHeader("tenant_id")
+
+	message.SetHeader("tenant_id", "1")
+	message.SetHeader("schema_version", "2")
+	value, ok = message.GetHeader("tenant_id")
+	assert.True(t, ok)
+	assert.Equal(t, "1", value)
+
+	message.RemoveHeader("tenant_id")
+	_, ok = message.GetHeader("tenant_id")
+	assert.False(t, ok)
+
+	buffer, err := json.Marshal(message)
+	assert.Nil(t, err)
+
+	message2 := queues.NewEmptyMessageEnvelope()
+	err = json.Unmarshal(buffer, message2)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"schema_version": "2"}, message2.Headers)
+}
+
+func (c *messageEnvelopeTest) TestCompressedJson(t *testing.T) {
+	items := []interface{}{}
+	for i := 0; i < 100; i++ {
+		items = append(items, map[string]interface{}{
+			"id":          float64(i),
+			"name":        "Test item",
+			"description": "This is a realistic payload with repeating content",
+		})
+	}
+	value := map[string]interface{}{"items": items}
+
+	message := queues.NewEmptyMessageEnvelope()
+	err := message.SetMessageAsCompressedJson(value)
+	assert.Nil(t, err)
+
+	encoding, ok := message.GetHeader("Content-Encoding")
+	assert.True(t, ok)
+	assert.Equal(t, "gzip", encoding)
+
+	raw, _ := json.Marshal(value)
+	assert.Less(t, len(message.Message), len(raw))
+
+	value2, err := message.GetMessageAsCompressedJson()
+	assert.Nil(t, err)
+	assert.Equal(t, value, value2)
+
+	message2 := queues.NewEmptyMessageEnvelope()
+	message2.SetMessageAsJson(value)
+	_, err = message2.GetMessageAsCompressedJson()
+	assert.True(t, errors.Is(err, queues.ErrMessageNotCompressed))
+}
+
+func (c *messageEnvelopeTest) TestClone(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "TestMessage", []byte("This is a test message"))
+	message.SetHeader("tenant_id", "1")
+	message.SetReference(1)
+
+	clone := message.Clone()
+	assert.Equal(t, message.MessageId, clone.MessageId)
+	assert.Equal(t, message.Message, clone.Message)
+	assert.Equal(t, message.Headers, clone.Headers)
+	assert.Nil(t, clone.GetReference())
+
+	clone.Message[0] = 'X'
+	clone.SetHeader("tenant_id", "2")
+	assert.Equal(t, []byte("This is a test message"), message.Message)
+	tenantId, _ := message.GetHeader("tenant_id")
+	assert.Equal(t, "1", tenantId)
+	assert.Equal(t, 1, message.GetReference())
+}
+
+func (c *messageEnvelopeTest) TestSerializeTextMessage(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "TestMessage", []byte("{\"value\":\"Привет\"}"))
+
+	buffer, err := json.Marshal(message)
+	assert.Nil(t, err)
+
+	var jsonData map[string]interface{}
+	err = json.Unmarshal(buffer, &jsonData)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"value\":\"Привет\"}", jsonData["message"])
+	assert.Equal(t, "utf8", jsonData["message_encoding"])
+
+	message2 := queues.NewEmptyMessageEnvelope()
+	err = json.Unmarshal(buffer, message2)
+	assert.Nil(t, err)
+	assert.Equal(t, message.Message, message2.Message)
+}
+
+func (c *messageEnvelopeTest) TestSerializeBinaryMessage(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "TestMessage", []byte{0xff, 0x00, 0xfe, 0x01})
+
+	buffer, err := json.Marshal(message)
+	assert.Nil(t, err)
+
+	var jsonData map[string]interface{}
+	err = json.Unmarshal(buffer, &jsonData)
+	assert.Nil(t, err)
+	assert.Equal(t, "/wD+AQ==", jsonData["message"])
+	assert.Equal(t, "base64", jsonData["message_encoding"])
+
+	message2 := queues.NewEmptyMessageEnvelope()
+	err = json.Unmarshal(buffer, message2)
+	assert.Nil(t, err)
+	assert.Equal(t, message.Message, message2.Message)
+}
+
+func (c *messageEnvelopeTest) TestFromJSON(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "TestMessage", []byte("This is a test message"))
+	message.SentTime = time.Now().UTC().Truncate(time.Millisecond)
+	message.GroupId = "group1"
+
+	buffer, err := json.Marshal(message)
+	assert.Nil(t, err)
+
+	message2, err := queues.NewMessageEnvelopeFromJSON(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, message.MessageId, message2.MessageId)
+	assert.Equal(t, message.CorrelationId, message2.CorrelationId)
+	assert.Equal(t, message.MessageType, message2.MessageType)
+	assert.Equal(t, message.GroupId, message2.GroupId)
+	assert.True(t, message.SentTime.Equal(message2.SentTime))
+	assert.Equal(t, message.Message, message2.Message)
+
+	message2, err = queues.NewMessageEnvelopeFromJSON([]byte("{\"message_id\":"))
+	assert.Nil(t, message2)
+	assert.True(t, errors.Is(err, queues.ErrInvalidMessageEnvelope))
+}
+
+func (c *messageEnvelopeTest) TestSentTime(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "TestMessage", []byte("This is a test message"))
+	assert.True(t, message.GetSentTime().IsZero())
+
+	sentTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	message.SetSentTime(sentTime)
+	assert.Equal(t, sentTime, message.SentTime)
+	assert.Equal(t, sentTime, message.GetSentTime())
+
+	// Queue stamps the sent time on the envelope
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	err := queue.Send("", message)
+	assert.Nil(t, err)
+	assert.True(t, message.GetSentTime().After(sentTime))
+
+	received, _ := queue.Receive("", 100*time.Millisecond)
+	assert.NotNil(t, received)
+	assert.Equal(t, message.CorrelationId, received.CorrelationId)
+	assert.True(t, message.GetSentTime().Equal(received.GetSentTime()))
+}
+
+func (c *messageEnvelopeTest) TestJsonWithError(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "TestMessage", nil)
+
+	value, err := message.GetMessageAsJsonWithError()
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	err = message.SetMessageAsJsonWithError(map[string]interface{}{"key": "value"})
+	assert.Nil(t, err)
+
+	value, err = message.GetMessageAsJsonWithError()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"key": "value"}, value)
+
+	// Unmarshalable value keeps the previous message
+	err = message.SetMessageAsJsonWithError(make(chan int))
+	assert.NotNil(t, err)
+	assert.Equal(t, "{\"key\":\"value\"}", message.GetMessageAsString())
+
+	message.SetMessageAsString("{invalid")
+	value, err = message.GetMessageAsJsonWithError()
+	assert.NotNil(t, err)
+	assert.Nil(t, value)
+}
+
+func (c *messageEnvelopeTest) TestFluentSetters(t *testing.T) {
+	message := queues.NewEmptyMessageEnvelope().
+		WithCorrelationId("123").
+		WithMessageType("abc").
+		WithMessageAsString("x")
+	assert.Equal(t, "123", message.CorrelationId)
+	assert.Equal(t, "abc", message.MessageType)
+	assert.Equal(t, "x", message.GetMessageAsString())
+
+	message = queues.NewEmptyMessageEnvelope().WithMessageAsJson(map[string]interface{}{"key": "value"})
+	assert.Equal(t, "{\"key\":\"value\"}", message.GetMessageAsString())
+}
+
+func (c *messageEnvelopeTest) TestContentType(t *testing.T) {
+	message := queues.NewEmptyMessageEnvelope()
+	assert.Equal(t, "", message.GetContentType())
+
+	message.SetMessageAsString("abc")
+	assert.Equal(t, queues.ContentTypeText, message.GetContentType())
+
+	_, err := message.GetMessageAsJsonWithError()
+	assert.True(t, errors.Is(err, queues.ErrUnexpectedContentType))
+
+	message.SetMessageAsJson(map[string]interface{}{"key": "value"})
+	assert.Equal(t, queues.ContentTypeJson, message.GetContentType())
+
+	value, err := message.GetMessageAsJsonWithError()
+	assert.Nil(t, err)
+	assert.Equal(t, "value", value.(map[string]interface{})["key"])
+
+	message.SetContentType("application/xml")
+	assert.Equal(t, "application/xml", message.GetContentType())
+	header, ok := message.GetHeader(queues.ContentTypeHeader)
+	assert.True(t, ok)
+	assert.Equal(t, "application/xml", header)
+}
+
+func (c *messageEnvelopeTest) TestValidate(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "Test", []byte("ABC"))
+	assert.Len(t, message.Validate(), 0)
+
+	message = queues.NewMessageEnvelope("123", "", []byte("ABC"))
+	errs := message.Validate()
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], queues.ErrInvalidMessageEnvelope))
+
+	message = queues.NewMessageEnvelope("123", "Test", nil)
+	assert.Len(t, message.Validate(), 1)
+
+	message = queues.NewEmptyMessageEnvelope()
+	assert.Len(t, message.Validate(), 3)
+}
+
+func (c *messageEnvelopeTest) TestTraceContext(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "Test", []byte("ABC"))
+	traceId, spanId := message.GetTraceContext()
+	assert.Equal(t, "", traceId)
+	assert.Equal(t, "", spanId)
+
+	message.SetTraceContext("trace1", "span1")
+	traceId, spanId = message.GetTraceContext()
+	assert.Equal(t, "trace1", traceId)
+	assert.Equal(t, "span1", spanId)
+
+	message.SetTraceContext("", "")
+	_, ok := message.GetHeader(queues.TraceIdHeader)
+	assert.False(t, ok)
+}
+
+type xmlTestMessage struct {
+	XMLName xml.Name `xml:"message"`
+	Id      string   `xml:"id"`
+	Count   int      `xml:"count"`
+}
+
+func (c *messageEnvelopeTest) TestXml(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "Test", nil)
+	err := message.SetMessageAsXml(xmlTestMessage{Id: "abc", Count: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, queues.ContentTypeXml, message.GetContentType())
+	assert.Equal(t, "<message><id>abc</id><count>5</count></message>", message.GetMessageAsString())
+
+	var value xmlTestMessage
+	err = message.GetMessageAsXml(&value)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", value.Id)
+	assert.Equal(t, 5, value.Count)
+
+	message.SetMessageAsJson(map[string]interface{}{"id": "abc"})
+	err = message.GetMessageAsXml(&value)
+	assert.True(t, errors.Is(err, queues.ErrUnexpectedContentType))
+}
+
+func (c *messageEnvelopeTest) TestSize(t *testing.T) {
+	message := queues.NewEmptyMessageEnvelope()
+	assert.Equal(t, 0, message.Size())
+
+	message.Message = []byte("ABCDE")
+	assert.Equal(t, 5, message.Size())
+
+	message.MessageType = "Test"
+	message.SetHeader("key", "value")
+	assert.Equal(t, 5+4+3+5, message.Size())
+}
+
+func (c *messageEnvelopeTest) TestEquals(t *testing.T) {
+	message := queues.NewMessageEnvelope("123", "Test", []byte("ABC"))
+	message.SetHeader("tenant", "1")
+	message.SetSentTime(time.Now())
+	message.SetReference(1)
+
+	// Received copy gets a new lock token, other fields are the same
+	received := message.Clone()
+	received.SetReference(2)
+	assert.True(t, message.EqualsContent(received))
+	assert.True(t, message.Equals(received))
+
+	// Resent message gets new id and sent time
+	resent := queues.NewMessageEnvelope("123", "Test", []byte("ABC"))
+	assert.True(t, message.EqualsContent(resent))
+	assert.False(t, message.Equals(resent))
+
+	received.SetHeader("tenant", "2")
+	assert.True(t, message.EqualsContent(received))
+	assert.False(t, message.Equals(received))
+
+	assert.False(t, message.EqualsContent(queues.NewMessageEnvelope("123", "Test", []byte("ABD"))))
+	assert.False(t, message.EqualsContent(queues.NewMessageEnvelope("124", "Test", []byte("ABC"))))
+	assert.False(t, message.EqualsContent(queues.NewMessageEnvelope("123", "Test2", []byte("ABC"))))
+	assert.False(t, message.EqualsContent(nil))
+	assert.False(t, message.Equals(nil))
+}
+
+func (c *messageEnvelopeTest) TestCompression(t *testing.T) {
+	payload := []byte(strings.Repeat("This is a payload with repeating content. ", 20))
+
+	for _, algo := range []string{queues.ContentEncodingGzip, queues.ContentEncodingDeflate} {
+		message := queues.NewEmptyMessageEnvelope()
+		err := message.SetMessageCompressed(payload, algo)
+		assert.Nil(t, err)
+
+		encoding, _ := message.GetHeader(queues.ContentEncodingHeader)
+		assert.Equal(t, algo, encoding)
+		assert.Less(t, len(message.Message), len(payload))
+
+		data, err := message.GetMessageDecompressed()
+		assert.Nil(t, err)
+		assert.Equal(t, payload, data)
+	}
+
+	// Not compressed payloads
+	message := queues.NewEmptyMessageEnvelope()
+	err := message.SetMessageCompressed(payload, queues.ContentEncodingNone)
+	assert.Nil(t, err)
+	_, ok := message.GetHeader(queues.ContentEncodingHeader)
+	assert.False(t, ok)
+
+	data, err := message.GetMessageDecompressed()
+	assert.Nil(t, err)
+	assert.Equal(t, payload, data)
+
+	message.SetHeader(queues.ContentEncodingHeader, queues.ContentEncodingNone)
+	data, err = message.GetMessageDecompressed()
+	assert.Nil(t, err)
+	assert.Equal(t, payload, data)
+
+	// Unknown encodings
+	err = message.SetMessageCompressed(payload, "br")
+	assert.True(t, errors.Is(err, queues.ErrUnsupportedEncoding))
+
+	message.SetHeader(queues.ContentEncodingHeader, "br")
+	_, err = message.GetMessageDecompressed()
+	assert.True(t, errors.Is(err, queues.ErrUnsupportedEncoding))
+}
+
 func TestMessageEnvelop(t *testing.T) {
 	test := NewMessageEnvelopTest()
 
 	t.Run("MessageEnvelop:Serialize Message", test.TestSerializeMessage)
+	t.Run("MessageEnvelop:Serialize Priority", test.TestSerializePriority)
+	t.Run("MessageEnvelop:Headers", test.TestHeaders)
+	t.Run("MessageEnvelop:Compressed Json", test.TestCompressedJson)
+	t.Run("MessageEnvelop:Compression", test.TestCompression)
+	t.Run("MessageEnvelop:Clone", test.TestClone)
+	t.Run("MessageEnvelop:Serialize Text Message", test.TestSerializeTextMessage)
+	t.Run("MessageEnvelop:Serialize Binary Message", test.TestSerializeBinaryMessage)
+	t.Run("MessageEnvelop:From JSON", test.TestFromJSON)
+	t.Run("MessageEnvelop:Sent Time", test.TestSentTime)
+	t.Run("MessageEnvelop:Json With Error", test.TestJsonWithError)
+	t.Run("MessageEnvelop:Fluent Setters", test.TestFluentSetters)
+	t.Run("MessageEnvelop:Content Type", test.TestContentType)
+	t.Run("MessageEnvelop:Validate", test.TestValidate)
+	t.Run("MessageEnvelop:Trace Context", test.TestTraceContext)
+	t.Run("MessageEnvelop:Xml", test.TestXml)
+	t.Run("MessageEnvelop:Size", test.TestSize)
+	t.Run("MessageEnvelop:Equals", test.TestEquals)
 }
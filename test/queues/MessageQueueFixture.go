@@ -1,6 +1,7 @@
 package test_queues
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -130,6 +131,28 @@ func (c *MessageQueueFixture) TestMoveToDeadMessage(t *testing.T) {
 	assert.Nil(t, mvErr)
 }
 
+func (c *MessageQueueFixture) TestReceiveFifoOrder(t *testing.T) {
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 1"))
+	envelope2 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 2"))
+	envelope3 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 3"))
+
+	for _, envelope := range []*queues.MessageEnvelope{envelope1, envelope2, envelope3} {
+		sndErr := c.queue.Send("", envelope)
+		assert.Nil(t, sndErr)
+	}
+
+	for _, envelope := range []*queues.MessageEnvelope{envelope1, envelope2, envelope3} {
+		received, rcvErr := c.queue.Receive("", 10000*time.Millisecond)
+		assert.Nil(t, rcvErr)
+		assert.NotNil(t, received)
+		assert.Equal(t, envelope.MessageId, received.MessageId)
+		assert.Equal(t, envelope.Message, received.Message)
+
+		cplErr := c.queue.Complete(received)
+		assert.Nil(t, cplErr)
+	}
+}
+
 func (c *MessageQueueFixture) TestOnMessage(t *testing.T) {
 	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message"))
 	receiver := TestMsgReceiver{}
@@ -142,7 +165,7 @@ func (c *MessageQueueFixture) TestOnMessage(t *testing.T) {
 
 	time.Sleep(1000 * time.Millisecond)
 
-	envelope2 := receiver.Message
+	envelope2 := receiver.GetMessage()
 	assert.NotNil(t, envelope2)
 	assert.Equal(t, envelope1.MessageType, envelope2.MessageType)
 	assert.Equal(t, envelope1.Message, envelope2.Message)
@@ -153,9 +176,20 @@ func (c *MessageQueueFixture) TestOnMessage(t *testing.T) {
 
 type TestMsgReceiver struct {
 	Message *queues.MessageEnvelope
+	lock    sync.Mutex
 }
 
 func (c *TestMsgReceiver) ReceiveMessage(message *queues.MessageEnvelope, queue queues.IMessageQueue) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	c.Message = message
 	return nil
 }
+
+func (c *TestMsgReceiver) GetMessage() *queues.MessageEnvelope {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.Message
+}
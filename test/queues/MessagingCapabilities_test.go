@@ -0,0 +1,32 @@
+package test_queues
+
+import (
+	"testing"
+
+	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessagingCapabilitiesBuilder(t *testing.T) {
+	capabilities := queues.NewMessagingCapabilitiesBuilder().Build()
+	assert.Equal(t, queues.NewMessagingCapabilities(false, false, false, false, false, false, false, false, false), capabilities)
+
+	capabilities = queues.NewMessagingCapabilitiesBuilder().
+		WithSend(true).
+		WithReceive(true).
+		WithDeadLetter(true).
+		Build()
+	assert.Equal(t, queues.NewMessagingCapabilities(false, true, true, false, false, false, false, true, false), capabilities)
+	assert.False(t, capabilities.CanMessageCount())
+	assert.True(t, capabilities.CanSend())
+	assert.True(t, capabilities.CanReceive())
+	assert.False(t, capabilities.CanPeek())
+	assert.False(t, capabilities.CanPeekBatch())
+	assert.False(t, capabilities.CanRenewLock())
+	assert.False(t, capabilities.CanAbandon())
+	assert.True(t, capabilities.CanDeadLetter())
+	assert.False(t, capabilities.CanClear())
+
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	assert.Equal(t, queues.NewMessagingCapabilities(true, true, true, true, true, true, true, true, true), queue.Capabilities())
+}
@@ -0,0 +1,48 @@
+package test_queues
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockMessageReceiver(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	receiver := queues.NewMockMessageReceiver()
+	go queue.Listen("", receiver)
+	defer queue.EndListen("")
+
+	envelope1 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 1"))
+	envelope2 := queues.NewMessageEnvelope("123", "Test", []byte("Test message 2"))
+	queue.Send("", envelope1)
+	queue.Send("", envelope2)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, 2, receiver.Count())
+	messages := receiver.Messages()
+	assert.Equal(t, envelope1.MessageId, messages[0].MessageId)
+	assert.Equal(t, envelope2.MessageId, messages[1].MessageId)
+
+	// Received messages are left to the caller
+	stats := queue.GetStats()
+	assert.Equal(t, int64(2), stats.LockedCount)
+	for _, message := range messages {
+		assert.Nil(t, queue.Complete(message))
+	}
+	stats = queue.GetStats()
+	assert.Equal(t, int64(0), stats.LockedCount)
+
+	// Configured error is returned to simulate failures
+	receiver.Clear()
+	receiver.SetError(errors.New("Test error"))
+	err := receiver.ReceiveMessage(queues.NewMessageEnvelope("123", "Test", []byte("Test message 3")), queue)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, receiver.Count())
+}
@@ -0,0 +1,69 @@
+package test_queues
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryMessageReceiver(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Configure(cconf.NewConfigParamsFromTuples(
+		"listen.ack_mode", "auto",
+	))
+	queue.Open("")
+	defer queue.Close("")
+
+	var attempts int32
+	var completed int32
+	handler := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			return errors.New("temporary failure")
+		}
+		atomic.AddInt32(&completed, 1)
+		return nil
+	})
+	receiver := queues.NewRetryMessageReceiver(handler, 3, 10*time.Millisecond, 2)
+
+	queue.BeginListen("", receiver)
+	defer queue.EndListen("")
+
+	start := time.Now()
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("Test message")))
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&completed) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// Retries waited 10ms and 20ms
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	assert.Eventually(t, func() bool {
+		count, _ := queue.ReadTotalMessageCount()
+		return count == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestRetryMessageReceiverFails(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	var attempts int32
+	failure := errors.New("permanent failure")
+	handler := queues.NewCallbackMessageReceiver(func(message *queues.MessageEnvelope, queue queues.IMessageQueue) error {
+		atomic.AddInt32(&attempts, 1)
+		return failure
+	})
+	receiver := queues.NewRetryMessageReceiver(handler, 2, time.Millisecond, 2)
+
+	err := receiver.ReceiveMessage(queues.NewMessageEnvelope("123", "Test", []byte("Test message")), queue)
+	assert.Equal(t, failure, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
@@ -0,0 +1,51 @@
+package test_queues
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pip-services3-go/pip-services3-messaging-go/queues"
+	"github.com/stretchr/testify/assert"
+)
+
+type typedTestMessage struct {
+	Id    string `json:"id"`
+	Count int    `json:"count"`
+}
+
+func TestTypedMessagesRoundTrip(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	err := queues.SendTyped(queue, "123", "Test", typedTestMessage{Id: "abc", Count: 5})
+	assert.Nil(t, err)
+
+	value, message, err := queues.ReceiveTyped[typedTestMessage](queue, "123", 10000*time.Millisecond)
+	assert.Nil(t, err)
+	assert.NotNil(t, message)
+	assert.Equal(t, "Test", message.MessageType)
+	assert.Equal(t, "123", message.CorrelationId)
+	assert.Equal(t, typedTestMessage{Id: "abc", Count: 5}, *value)
+	assert.Nil(t, queue.Complete(message))
+
+	// Empty queue
+	value, message, err = queues.ReceiveTyped[typedTestMessage](queue, "123", 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+	assert.Nil(t, message)
+}
+
+func TestTypedMessagesDecodeError(t *testing.T) {
+	queue := queues.NewMemoryMessageQueue("TestQueue")
+	queue.Open("")
+	defer queue.Close("")
+
+	queue.Send("", queues.NewMessageEnvelope("123", "Test", []byte("not a json")))
+
+	value, message, err := queues.ReceiveTyped[typedTestMessage](queue, "123", 10000*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Nil(t, value)
+	assert.NotNil(t, message)
+	assert.Nil(t, queue.Abandon(message))
+}